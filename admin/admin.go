@@ -1,45 +1,82 @@
 package admin
 
 import (
+	"context"
 	"html/template"
 	"net/http"
 	"path/filepath"
+	"sync"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/qor/admin"
+	"github.com/qor/assetfs"
 	"github.com/sirupsen/logrus"
 
 	"qor-admin-3/admin/bindatafs"
-	"qor-admin-3/models"
+	"qor-admin-3/admin/dynamo"
+	"qor-admin-3/admin/tracing"
 )
 
 // Admin abstracts the whole QOR Admin + authentication process
 type Admin struct {
+	config    Config
 	db        *gorm.DB
-	auth      auth
+	auth      *auth
 	adm       *admin.Admin
 	adminpath string
 	prefix    string
+	scim      *scimConfig // nil unless the SCIM endpoints are enabled
+	sync      *ldapSync   // nil unless the directory sync is enabled
+	health    *health
+	metrics   *metrics
+	dynamo    *dynamo.DB // shared by the DynamoDB resources, see dynamoDB
+	// migrations provision the storage of the registered resources
+	migrations []func(ctx context.Context) error
+	jobs       []func() // background jobs, see StartJobs
+	stop       chan struct{}
+	closeOnce  sync.Once
+
+	handlerOnce sync.Once
+	handler     http.Handler
 }
 
 // New will create a new admin using the provided gorm connection, a prefix
 // for the various routes. Prefix can be an empty string. The cookie secret
-// will be used to encrypt/decrypt the cookie on the backend side.
+// will be used to encrypt/decrypt the cookie on the backend side. Models are
+// then added with Register.
 func New(db *gorm.DB, prefix, cookiesecret string) *Admin {
+	cfg := DefaultConfig()
+	cfg.Prefix = prefix
+	cfg.CookieSecret = cookiesecret
+	return NewWithConfig(db, cfg)
+}
+
+// NewWithConfig creates a new admin using the provided gorm connection and
+// configuration, see LoadConfig.
+func NewWithConfig(db *gorm.DB, cfg Config) *Admin {
+	prefix, cookiesecret := cfg.Prefix, cfg.CookieSecret
 	adminpath := filepath.Join(prefix, "/admin")
 	a := Admin{
+		config:    cfg,
 		db:        db,
 		prefix:    prefix,
 		adminpath: adminpath,
-		auth: auth{
-			// db: db,
+		stop:      make(chan struct{}),
+		health:    newHealth(cfg.Health),
+		metrics:   newMetrics(cfg.Metrics),
+		auth: &auth{
+			db:     db,
+			secret: []byte(cookiesecret),
 			paths: pathConfig{
 				admin:  adminpath,
 				login:  filepath.Join(prefix, "/login"),
 				logout: filepath.Join(prefix, "/logout"),
+				forgot: filepath.Join(prefix, "/forgot"),
+				reset:  filepath.Join(prefix, "/reset"),
+				invite: filepath.Join(prefix, "/invite"),
 			},
 			session: sessionConfig{
 				key:   "email",
@@ -48,38 +85,197 @@ func New(db *gorm.DB, prefix, cookiesecret string) *Admin {
 			},
 		},
 	}
+	a.auth.metrics = a.metrics
+	a.auth.ldap = &directory{config: cfg.LDAP.LDAP(), metrics: a.metrics}
+	if cfg.Metrics.Role != "" {
+		registerRole(cfg.Metrics.Role)
+	}
+	if err := db.AutoMigrate(&adminUser{}).Error; err != nil {
+		logrus.WithError(err).Fatal("Unable to migrate the admin users table")
+	}
+	if err := registerStoredRoles(db); err != nil {
+		logrus.WithError(err).Warn("Couldn't load the roles of the admin users")
+	}
+	a.health.add("database", func(ctx context.Context) error {
+		return db.DB().PingContext(ctx)
+	})
+	a.health.add("ldap", func(ctx context.Context) error {
+		client, err := a.auth.ldap.get()
+		if err != nil {
+			return err
+		}
+		return withLog(ctx, client).Ping()
+	})
 	a.adm = admin.New(&admin.AdminConfig{
-		SiteName: "My Admin Interface",
+		SiteName: cfg.SiteName,
 		DB:       db,
 		Auth:     a.auth,
 		AssetFS:  bindatafs.AssetFS.NameSpace("admin"),
 	})
-	customerResource := a.adm.AddResource(&models.Customer{})
-	// models.ConfigureQorResource(customerResource)
-	models.ConfigureQorResourceDynamoDB(customerResource) //to run DynamoDB local: java -Djava.library.path=./DynamoDBLocal_lib -jar DynamoDBLocal.jar -sharedDb
 	return &a
 }
 
-// Bind will bind the admin interface to an already existing gin router
-// (*gin.Engine).
-func (a Admin) Bind(r *gin.Engine) {
+// StartJobs starts the background jobs of the admin, ex. the directory sync or
+// the purge of the DynamoDB trash. Only the server should start them, once, and
+// they run until Close is called.
+func (a *Admin) StartJobs() {
+	for _, job := range a.jobs {
+		go job()
+	}
+}
+
+// Close stops the background jobs of the admin and closes its LDAP
+// connections. It can be called more than once. The gorm connection belongs
+// to the caller and is left open.
+func (a *Admin) Close() error {
+	a.closeOnce.Do(func() { close(a.stop) })
+	err := a.auth.ldap.Close()
+	if a.auth.cert != nil && a.auth.cert.ldap != nil {
+		if cerr := a.auth.cert.ldap.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if a.sync != nil {
+		if serr := a.sync.client.Close(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Handler returns an http.Handler serving the admin interface, the login
+// pages and the other enabled endpoints. The routes include the prefix, so it
+// can be mounted on any net/http router, ex. mux.Handle("/", a.Handler()).
+// The admin must not be configured any further once it is called.
+func (a *Admin) Handler() http.Handler {
+	a.handlerOnce.Do(func() {
+		sealRoles()
+		e := gin.New()
+		a.routes(e)
+		a.handler = e
+	})
+	return a.handler
+}
+
+// paths lists the routes served by Handler, relative to the prefix
+func (a *Admin) paths() []string {
+	paths := []string{"/admin/*resources", "/healthz", "/readyz", "/metrics", "/loglevel"}
+	if a.scim != nil {
+		paths = append(paths, "/scim/v2/*scim")
+	}
+	if a.auth.proxy != nil {
+		return paths
+	}
+	paths = append(paths, "/login", "/logout")
+	if a.auth.local != nil {
+		paths = append(paths, "/forgot", "/reset", "/invite")
+	}
+	return paths
+}
+
+// monitoring registers /metrics and /loglevel behind the middlewares
+func (a *Admin) monitoring(r gin.IRoutes, middlewares ...gin.HandlerFunc) {
+	chain := func(h gin.HandlerFunc) []gin.HandlerFunc {
+		return append(append([]gin.HandlerFunc{}, middlewares...), h)
+	}
+	r.GET("/metrics", chain(a.metrics.Handler())...)
+	r.GET("/loglevel", chain(a.logLevel)...)
+	r.PUT("/loglevel", chain(a.logLevel)...)
+}
+
+// MetricsHandler serves /metrics and /loglevel without any access check, for
+// a separate listener only the monitoring can reach, see MetricsConfig
+func (a *Admin) MetricsHandler() http.Handler {
+	e := gin.New()
+	e.Use(RequestLog)
+	a.monitoring(e)
+	return e
+}
+
+// routes registers the handlers of the admin on its private engine
+func (a *Admin) routes(e *gin.Engine) {
 	mux := http.NewServeMux()
 	a.adm.MountTo(a.adminpath, mux)
 
-	lfs := bindatafs.AssetFS.NameSpace("login")
-	lfs.RegisterPath("admin/templates/")
-	logintpl, err := lfs.Asset("login.html")
-	if err != nil {
-		logrus.WithError(err).Fatal("Unable to find HTML template for login page in admin")
+	a.auth.templates = loadTemplates("login.html", "forgot.html", "password.html")
+
+	a.metrics.resourcesByParam = map[string]bool{}
+	for _, res := range a.adm.GetResources() {
+		a.metrics.resourcesByParam[res.ToParam()] = true
 	}
-	r.SetHTMLTemplate(template.Must(template.New("login.html").Parse(string(logintpl))))
+	e.Use(tracing.Middleware, RequestLog, a.metrics.Instrument)
 
-	g := r.Group(a.prefix)
+	// the probes are anonymous and don't need a session
+	e.GET(filepath.Join(a.prefix, "/healthz"), a.health.Healthz)
+	e.GET(filepath.Join(a.prefix, "/readyz"), a.health.Readyz)
+
+	g := e.Group(a.prefix)
 	g.Use(sessions.Sessions(a.auth.session.name, a.auth.session.store))
+	if a.scim != nil {
+		a.scim.bind(g, a.db)
+	}
+	if a.auth.proxy != nil {
+		// The proxy already authenticated the user, there is no login page
+		g.Any("/admin/*resources", a.auth.ProxyAuth, gin.WrapH(mux))
+		a.monitoring(g, a.metrics.Restrict(a.auth))
+		return
+	}
+	if a.auth.cert != nil {
+		g.Use(a.auth.ClientCertAuth)
+	}
 	{
 		g.Any("/admin/*resources", gin.WrapH(mux))
+		a.monitoring(g, a.metrics.Restrict(a.auth))
 		g.GET("/login", a.auth.GetLogin)
 		g.POST("/login", a.auth.PostLogin)
 		g.GET("/logout", a.auth.GetLogout)
+		if a.auth.local != nil {
+			g.GET("/forgot", a.auth.GetForgot)
+			g.POST("/forgot", a.auth.PostForgot)
+			g.GET("/reset", a.auth.GetPassword(tokenReset))
+			g.POST("/reset", a.auth.PostPassword(tokenReset))
+			g.GET("/invite", a.auth.GetPassword(tokenInvite))
+			g.POST("/invite", a.auth.PostPassword(tokenInvite))
+		}
+	}
+}
+
+// loginFS returns the assets of the login pages
+func loginFS() assetfs.Interface {
+	lfs := bindatafs.AssetFS.NameSpace("login")
+	lfs.RegisterPath("admin/templates/")
+	return lfs
+}
+
+// CompileAssets embeds the templates of the admin, including the login pages,
+// in the binary. It must be run from the root of the repository, then the
+// binary built with the bindatafs tag.
+func (a *Admin) CompileAssets() error {
+	loginFS()
+	return bindatafs.AssetFS.Compile()
+}
+
+// loadTemplates parses the pages of the admin in a private template set, so
+// the HTML renderer of the host engine is left untouched
+func loadTemplates(names ...string) *template.Template {
+	lfs := loginFS()
+	tpl := template.New("")
+	for _, name := range names {
+		content, err := lfs.Asset(name)
+		if err != nil {
+			logrus.WithError(err).Fatalf("Unable to find HTML template for %s in admin", name)
+		}
+		template.Must(tpl.New(name).Parse(string(content)))
+	}
+	return tpl
+}
+
+// Bind will bind the admin interface to an already existing gin router
+// (*gin.Engine). It forwards the admin routes to Handler.
+func (a *Admin) Bind(r *gin.Engine) {
+	h := gin.WrapH(a.Handler())
+	g := r.Group(a.prefix)
+	for _, path := range a.paths() {
+		g.Any(path, h)
 	}
 }
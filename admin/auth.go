@@ -1,31 +1,96 @@
 package admin
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"html/template"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+	"github.com/jinzhu/gorm"
 
 	// "github.com/nerney/dappy"
 
 	"github.com/qor/admin"
 	"github.com/qor/qor"
-	"github.com/sirupsen/logrus"
+	"github.com/qor/roles"
 
 	"qor-admin-3/admin/ldap"
+	"qor-admin-3/admin/logging"
+	"qor-admin-3/admin/tracing"
 )
 
 // Auth is a structure to handle authentication for QOR. It will satisify the
 // qor.Auth interface.
 type auth struct {
+	db      *gorm.DB
+	secret  []byte
+	ldap    *directory
 	session sessionConfig
 	paths   pathConfig
+	proxy   *proxyConfig // nil unless the proxy authentication mode is used
+	cert    *certConfig  // nil unless the client certificate authentication mode is used
+	local   *localConfig // nil unless local accounts are enabled
+	metrics *metrics
+
+	templates *template.Template // pages of the admin, see loadTemplates
+}
+
+// directory holds the LDAP client shared by the logins. It connects lazily
+// so the admin starts even when the directory is unreachable.
+type directory struct {
+	config  ldap.Config
+	metrics *metrics
+	mu      sync.Mutex
+	client  ldap.Client
 }
 
+// get returns the shared client, connecting it on first use
+func (d *directory) get() (ldap.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client == nil {
+		client, err := ldap.New(d.config)
+		if err != nil {
+			return nil, err
+		}
+		d.client = d.metrics.ldap(client)
+	}
+	return d.client, nil
+}
+
+// Close closes the connections of the shared client
+func (d *directory) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client == nil {
+		return nil
+	}
+	err := d.client.Close()
+	d.client = nil
+	return err
+}
+
+// sessionLoginAt is the session value holding the unix time of the login in
+// nanoseconds, like the SessionsRevokedAt it is compared with
+const sessionLoginAt = "login_at"
+
+// sessionUserID is the session value holding the ID of the user in the
+// database at login: the session ends when the user is deleted
+const sessionUserID = "user_id"
+
+var errUserDisabled = errors.New("admin user is disabled")
+
+// currentUserKey stores the *adminUser authenticated by a middleware in the
+// request context
+type currentUserKey struct{}
+
 type sessionConfig struct {
 	name  string
 	key   string
@@ -36,15 +101,26 @@ type pathConfig struct {
 	login  string
 	logout string
 	admin  string
+	forgot string
+	reset  string
+	invite string
 }
 
 type adminUser struct {
-	Email     string `gorm:"not null;unique"`
-	Brid      string `gorm:"not null;unique"`
-	FirstName string
-	LastName  string
-	Password  []byte
-	LastLogin *time.Time
+	ID                uint   `gorm:"primary_key"`
+	Email             string `gorm:"not null;unique"`
+	Brid              string `gorm:"not null;unique"`
+	FirstName         string
+	LastName          string
+	Password          []byte
+	LastLogin         *time.Time
+	Roles             string // comma separated list of roles
+	Disabled          bool
+	DisabledBySync    bool       // disabled by the directory sync, which can enable it again
+	SessionsRevokedAt *time.Time // sessions opened before this time are rejected
+	LDAPDN            string     `gorm:"column:ldap_dn"` // set for the users synchronised from the directory
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
 }
 
 func (u adminUser) DisplayName() string {
@@ -54,18 +130,133 @@ func (u adminUser) DisplayName() string {
 	return u.Email
 }
 
+// valid reports if a session opened at loginAt is still valid for the user
+func (u adminUser) valid(loginAt time.Time) bool {
+	return !u.Disabled && (u.SessionsRevokedAt == nil || loginAt.After(*u.SessionsRevokedAt))
+}
+
+func (u adminUser) hasRole(role string) bool {
+	for _, r := range strings.Split(u.Roles, ",") {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// declaredRoles tracks the roles declared to qor. The qor roles map isn't
+// safe for concurrent use, so it's sealed once the admin serves requests.
+var declaredRoles = struct {
+	sync.Mutex
+	names  map[string]bool
+	sealed bool
+}{names: map[string]bool{}}
+
+// registerRole declares a role to qor, granted to the admin users holding it.
+// It returns false when the role is new and the roles are sealed: it's then
+// declared on the next start.
+func registerRole(role string) bool {
+	declaredRoles.Lock()
+	defer declaredRoles.Unlock()
+	if declaredRoles.names[role] {
+		return true
+	}
+	if declaredRoles.sealed {
+		return false
+	}
+	declaredRoles.names[role] = true
+	roles.Register(role, func(req *http.Request, currentUser interface{}) bool {
+		switch u := currentUser.(type) {
+		case adminUser:
+			return u.hasRole(role)
+		case *adminUser:
+			return u != nil && u.hasRole(role)
+		}
+		return false
+	})
+	return true
+}
+
+// sealRoles stops declaring roles to qor, see registerRole
+func sealRoles() {
+	declaredRoles.Lock()
+	declaredRoles.sealed = true
+	declaredRoles.Unlock()
+}
+
+// render writes one of the admin pages without relying on the HTML renderer
+// of the engine
+func (a *auth) render(c *gin.Context, code int, name string, data interface{}) {
+	_, span := tracing.Start(c.Request.Context(), "render "+name)
+	defer span.End()
+	c.Render(code, render.HTML{Template: a.templates, Name: name, Data: data})
+}
+
 // GetLogin simply returns the login page
 func (a *auth) GetLogin(c *gin.Context) {
 	if sessions.Default(c).Get(a.session.key) != nil {
-		fmt.Println("redirect happen!")
 		c.Redirect(http.StatusSeeOther, a.paths.admin)
 		return
 	}
-	c.HTML(http.StatusOK, "login.html", gin.H{})
+	page := gin.H{}
+	if a.local != nil {
+		page["Forgot"] = a.paths.forgot
+	}
+	a.render(c, http.StatusOK, "login.html", page)
+}
+
+// directoryUser returns the admin user of the directory entry found for the
+// login, see entryUser
+func (a *auth) directoryUser(client ldap.Client, username string) (adminUser, error) {
+	entry, err := client.Lookup(username)
+	if err != nil {
+		return adminUser{}, err
+	}
+	return a.entryUser(entry)
+}
+
+// entryUser creates or updates the admin user of a directory entry. The row
+// is only written when the entry changed or the last login is stale.
+func (a *auth) entryUser(e ldap.Entry) (adminUser, error) {
+	var user adminUser
+	switch {
+	case e.Disabled:
+		return user, errUserDisabled
+	case e.Mail == "":
+		return user, fmt.Errorf("directory entry %s has no mail attribute", e.DN)
+	case e.UID == "":
+		// the uid is the unique brid of the user created on first login
+		return user, fmt.Errorf("directory entry %s has no uid attribute", e.DN)
+	}
+	now := time.Now()
+	err := a.db.Where(adminUser{Email: e.Mail}).First(&user).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		user = adminUser{Email: e.Mail, Brid: e.UID, FirstName: e.GivenName, LastName: e.Surname, LDAPDN: e.DN, LastLogin: &now}
+		return user, a.db.Create(&user).Error
+	case err != nil:
+		return user, err
+	case user.Disabled:
+		return user, errUserDisabled
+	}
+	if user.FirstName != e.GivenName || user.LastName != e.Surname || user.LDAPDN != e.DN ||
+		user.LastLogin == nil || now.Sub(*user.LastLogin) > lastLoginInterval {
+		user.FirstName, user.LastName, user.LDAPDN, user.LastLogin = e.GivenName, e.Surname, e.DN, &now
+		if err := a.db.Model(&user).Updates(map[string]interface{}{
+			"first_name": e.GivenName,
+			"last_name":  e.Surname,
+			"ldap_dn":    e.DN,
+			"last_login": &now,
+		}).Error; err != nil {
+			return user, err
+		}
+	}
+	return user, nil
 }
 
 // PostLogin is the handler to check if the user can connect
 func (a *auth) PostLogin(c *gin.Context) {
+	log := logging.FromContext(c.Request.Context())
 	session := sessions.Default(c)
 	email := c.PostForm("email")
 	password := c.PostForm("password")
@@ -74,18 +265,25 @@ func (a *auth) PostLogin(c *gin.Context) {
 		return
 	}
 
+	if a.local != nil {
+		var user adminUser
+		if err := a.db.Where(adminUser{Email: email}).First(&user).Error; err == nil && len(user.Password) > 0 {
+			a.localLogin(c, user, password)
+			return
+		}
+	}
+
 	var client ldap.Client
 	var err error
 
-	// create a new client
-	if client, err = ldap.New(ldap.Config{
-		BaseDN: "dc=example,dc=com",
-		Filter: "uid",
-		ROUser: ldap.User{Name: "cn=read-only-admin,dc=example,dc=com", Pass: "password"},
-		Host:   "ldap.forumsys.com:389",
-	}); err != nil {
-		panic(err)
+	// get the shared client
+	if client, err = a.ldap.get(); err != nil {
+		a.metrics.login("ldap", "error")
+		log.WithError(err).Error("Unable to connect to the directory")
+		c.Redirect(http.StatusSeeOther, a.paths.login)
+		return
 	}
+	client = withLog(c.Request.Context(), client)
 
 	// email and password to authenticate
 	// email := "tesla"
@@ -93,21 +291,36 @@ func (a *auth) PostLogin(c *gin.Context) {
 
 	// attempt the authentication
 	if err := client.Auth(email, password); err != nil {
+		if err == ldap.ErrInvalidCredentials {
+			a.metrics.login("ldap", "failure")
+			log.WithField("email", email).Info("Login rejected")
+		} else {
+			a.metrics.login("ldap", "error")
+			log.WithError(err).Error("Unable to authenticate with the directory")
+		}
 		session := sessions.Default(c)
 		session.Delete(a.session.key)
 		if err := session.Save(); err != nil {
-			logrus.WithError(err).Warn("Couldn't save session")
+			log.WithError(err).Warn("Couldn't save session")
 		}
 		c.Redirect(http.StatusSeeOther, a.paths.login)
 		// panic(err)
 	} else {
-		log.Println("Success!")
-		session.Set(a.session.key, email)
-		fmt.Println(session)
-		err = session.Save()
-		fmt.Println("err is ", err)
+		// the sessions belong to admin users, the first login creates it
+		user, err := a.directoryUser(client, email)
 		if err != nil {
-			logrus.WithError(err).Warn("Couldn't save session")
+			a.metrics.login("ldap", "failure")
+			log.WithError(err).WithField("email", email).Warn("Login rejected")
+			c.Redirect(http.StatusSeeOther, a.paths.login)
+			return
+		}
+		a.metrics.login("ldap", "success")
+		log.WithField("email", email).Info("Logged in")
+		session.Set(a.session.key, user.Email)
+		session.Set(sessionLoginAt, time.Now().UnixNano())
+		session.Set(sessionUserID, user.ID)
+		if err = session.Save(); err != nil {
+			log.WithError(err).Warn("Couldn't save session")
 			c.Redirect(http.StatusSeeOther, a.paths.login)
 			return
 		}
@@ -121,13 +334,26 @@ func (a *auth) GetLogout(c *gin.Context) {
 	session := sessions.Default(c)
 	session.Delete(a.session.key)
 	if err := session.Save(); err != nil {
-		logrus.WithError(err).Warn("Couldn't save session")
+		logging.FromContext(c.Request.Context()).WithError(err).Warn("Couldn't save session")
 	}
 	c.Redirect(http.StatusSeeOther, a.paths.login)
 }
 
 // GetCurrentUser satisfies the Auth interface and returns the current user
 func (a auth) GetCurrentUser(c *admin.Context) qor.CurrentUser {
+	if user, ok := c.Request.Context().Value(currentUserKey{}).(*adminUser); ok {
+		a.metrics.active(user.Email)
+		return *user
+	}
+	if a.proxy != nil {
+		user, err := a.proxyUser(c.Request)
+		if err != nil {
+			return nil
+		}
+		a.metrics.active(user.Email)
+		return *user
+	}
+
 	// var userid uint
 	var email string
 
@@ -137,26 +363,39 @@ func (a auth) GetCurrentUser(c *admin.Context) qor.CurrentUser {
 	}
 	if v, ok := s.Values[a.session.key]; ok {
 		email = v.(string)
-		fmt.Println("User is ", email)
 	} else {
 		return nil
 	}
 
-	var AdminUser adminUser
-	AdminUser.Email = "Administrator"
-	return AdminUser
-
-	// return nil
+	// the users can be disabled, deleted or have their sessions revoked, the
+	// session ends with them
+	userID, _ := s.Values[sessionUserID].(uint)
+	var user adminUser
+	if err := a.db.Where(adminUser{Email: email}).First(&user).Error; err != nil {
+		return nil
+	}
+	loginAt, _ := s.Values[sessionLoginAt].(int64)
+	if user.ID != userID || !user.valid(time.Unix(0, loginAt)) {
+		return nil
+	}
+	a.metrics.active(user.Email)
+	return user
 }
 
 // LoginURL statisfies the Auth interface and returns the route used to log
 // users in
 func (a auth) LoginURL(c *admin.Context) string { // nolint: unparam
+	if a.proxy != nil {
+		return a.proxy.loginURL
+	}
 	return a.paths.login
 }
 
 // LogoutURL statisfies the Auth interface and returns the route used to logout
 // a user
 func (a auth) LogoutURL(c *admin.Context) string { // nolint: unparam
+	if a.proxy != nil {
+		return a.proxy.logoutURL
+	}
 	return a.paths.logout
 }
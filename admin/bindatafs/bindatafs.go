@@ -117,7 +117,6 @@ func (assetFS *bindataFS) Compile() error {
 	config.Prefix = filepath.Join(assetFS.Path, "templates")
 	config.NoMetadata = true
 
-	defer os.Exit(0)
 	return bindata.Translate(config)
 }
 
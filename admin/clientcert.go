@@ -0,0 +1,215 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"qor-admin-3/admin/ldap"
+	"qor-admin-3/admin/logging"
+)
+
+// Client certificate mappings, they define how a verified certificate is
+// turned into an admin user
+const (
+	CertMapEmail = "email" // the first email SAN matches adminUser.Email
+	CertMapCN    = "cn"    // the subject common name matches adminUser.Brid
+	CertMapLDAP  = "ldap"  // the subject DN, or else the common name, is looked up in the directory
+)
+
+// certLookupTTL is how long a directory entry found for a certificate is
+// reused, so that every request doesn't search the directory
+const certLookupTTL = time.Minute
+
+// ClientCertConfig configures the mutual-TLS authentication mode
+type ClientCertConfig struct {
+	CAFile   string       // PEM bundle of the CAs allowed to issue client certificates
+	Required bool         // reject TLS handshakes without a client certificate
+	Mapping  string       // one of CertMapEmail, CertMapCN or CertMapLDAP, defaults to CertMapEmail
+	LDAP     *ldap.Config // required for CertMapLDAP
+}
+
+type certConfig struct {
+	pool     *x509.CertPool
+	required bool
+	mapping  string
+	ldap     ldap.Client
+
+	mu      sync.Mutex
+	entries map[string]cachedEntry // by subject
+}
+
+type cachedEntry struct {
+	entry   ldap.Entry
+	expires time.Time
+}
+
+var errNoClientCert = errors.New("no verified client certificate")
+
+// newCertConfig validates the configuration and loads the CA bundle
+func newCertConfig(cfg ClientCertConfig) (*certConfig, error) {
+	pem, err := ioutil.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("[CONFIG] Unable to read client CA file: %v", err)
+	}
+	c := certConfig{
+		pool:     x509.NewCertPool(),
+		required: cfg.Required,
+		mapping:  cfg.Mapping,
+		entries:  map[string]cachedEntry{},
+	}
+	if !c.pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("[CONFIG] No certificate found in %s", cfg.CAFile)
+	}
+	switch c.mapping {
+	case "":
+		c.mapping = CertMapEmail
+	case CertMapEmail, CertMapCN:
+	case CertMapLDAP:
+		if cfg.LDAP == nil {
+			return nil, errors.New("[CONFIG] The ldap certificate mapping requires an LDAP configuration")
+		}
+		if c.ldap, err = ldap.New(*cfg.LDAP); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("[CONFIG] Unknown certificate mapping %q", cfg.Mapping)
+	}
+	return &c, nil
+}
+
+// certUser returns the admin user matching the verified client certificate
+// of the request
+func (a *auth) certUser(req *http.Request) (*adminUser, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, errNoClientCert
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+
+	var user adminUser
+	var err error
+	switch a.cert.mapping {
+	case CertMapEmail:
+		if len(cert.EmailAddresses) == 0 {
+			return nil, errors.New("client certificate has no email SAN")
+		}
+		err = a.db.Where(adminUser{Email: cert.EmailAddresses[0]}).First(&user).Error
+	case CertMapCN:
+		if cert.Subject.CommonName == "" {
+			return nil, errors.New("client certificate has no common name")
+		}
+		err = a.db.Where(adminUser{Brid: cert.Subject.CommonName}).First(&user).Error
+	case CertMapLDAP:
+		var entry ldap.Entry
+		if entry, err = a.cert.entry(withLog(req.Context(), a.cert.ldap), cert); err != nil {
+			return nil, err
+		}
+		user, err = a.entryUser(entry)
+	}
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("no admin user for certificate %s", cert.Subject)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, errUserDisabled
+	}
+	return &user, nil
+}
+
+// entry returns the directory entry of the certificate. The subject is
+// formatted by Go, ex. "CN=ada,O=Example", which may differ from the DN in the
+// directory (order, case, escaping): when nothing is found at that DN, the
+// common name is looked up with the login filter instead, see ldap.Config.
+// The entries are cached for certLookupTTL.
+func (c *certConfig) entry(client ldap.Client, cert *x509.Certificate) (ldap.Entry, error) {
+	subject := cert.Subject.String()
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.entries[subject]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.entry, nil
+	}
+
+	entry, err := client.LookupDN(subject)
+	if err != nil && cert.Subject.CommonName != "" {
+		entry, err = client.Lookup(cert.Subject.CommonName)
+	}
+	if err != nil {
+		return entry, fmt.Errorf("no directory entry for certificate %s: %v", subject, err)
+	}
+	c.mu.Lock()
+	for s, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, s)
+		}
+	}
+	c.entries[subject] = cachedEntry{entry: entry, expires: now.Add(certLookupTTL)}
+	c.mu.Unlock()
+	return entry, nil
+}
+
+// ClientCertAuth is a middleware which authenticates the request using the
+// verified client certificate. When certificates are optional, requests
+// without one fall back to the login form.
+func (a *auth) ClientCertAuth(c *gin.Context) {
+	user, err := a.certUser(c.Request)
+	if err == errNoClientCert && !a.cert.required {
+		c.Next()
+		return
+	}
+	if err != nil {
+		logging.FromContext(c.Request.Context()).WithError(err).WithField("remote", c.Request.RemoteAddr).Warn("Client certificate authentication failed")
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), currentUserKey{}, user))
+	c.Next()
+}
+
+// UseClientCertAuth enables the mutual-TLS authentication mode. The server
+// must then be started with the configuration returned by TLSConfig.
+func (a *Admin) UseClientCertAuth(cfg ClientCertConfig) error {
+	c, err := newCertConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if c.ldap != nil {
+		c.ldap = a.metrics.ldap(c.ldap)
+	}
+	a.auth.cert = c
+	return nil
+}
+
+// TLSConfig returns the TLS configuration to serve the admin with, including
+// the client certificate verification when UseClientCertAuth was called.
+func (a *Admin) TLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if a.auth.cert != nil {
+		cfg.ClientCAs = a.auth.cert.pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if a.auth.cert.required {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
+}
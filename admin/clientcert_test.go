@@ -0,0 +1,349 @@
+package admin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+
+	"qor-admin-3/admin/ldap"
+)
+
+// testCA is a certificate authority generated for a test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate signed by the CA for the template
+func (ca testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// file writes the PEM certificate of the CA in a temporary file
+func (ca testCA) file(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// client returns a client certificate signed by the CA
+func (ca testCA) client(t *testing.T, cn, email string) tls.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if email != "" {
+		template.EmailAddresses = []string{email}
+	}
+	return ca.issue(t, template)
+}
+
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.AutoMigrate(&adminUser{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// certServer serves the user authenticated by the client certificate, or the
+// error, over mutual TLS
+func certServer(t *testing.T, a *auth, ca testCA) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, err := a.certUser(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(user.Email))
+	}))
+	server := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    a.cert.pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// get requests the server with the client certificate, if any, and returns
+// the status and body
+func get(t *testing.T, srv *httptest.Server, ca testCA, cert *tls.Certificate) (int, string) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	res, err := client.Get(srv.URL)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, strings.TrimSpace(string(body))
+}
+
+func TestNewCertConfig(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cfg  ClientCertConfig
+		err  string
+	}{
+		{"default mapping", ClientCertConfig{CAFile: ca.file(t)}, ""},
+		{"cn mapping", ClientCertConfig{CAFile: ca.file(t), Mapping: CertMapCN}, ""},
+		{"missing file", ClientCertConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, "Unable to read client CA file"},
+		{"no certificate", ClientCertConfig{CAFile: empty}, "No certificate found"},
+		{"unknown mapping", ClientCertConfig{CAFile: ca.file(t), Mapping: "serial"}, "Unknown certificate mapping"},
+		{"ldap without directory", ClientCertConfig{CAFile: ca.file(t), Mapping: CertMapLDAP}, "requires an LDAP configuration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCertConfig(tt.cfg)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.mapping == "" {
+					t.Error("the mapping isn't set")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCertUser(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	other := newTestCA(t, "Other CA")
+	db := testDB(t)
+	for _, u := range []adminUser{
+		{Email: "ada@example.com", Brid: "ada"},
+		{Email: "bob@example.com", Brid: "bob", Disabled: true},
+	} {
+		if err := db.Create(&u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ada := ca.client(t, "ada", "ada@example.com")
+	bob := ca.client(t, "bob", "bob@example.com")
+	unknown := ca.client(t, "eve", "eve@example.com")
+	noEmail := ca.client(t, "ada", "")
+	untrusted := other.client(t, "ada", "ada@example.com")
+
+	tests := []struct {
+		name    string
+		mapping string
+		cert    *tls.Certificate
+		status  int
+		body    string
+	}{
+		{"email", CertMapEmail, &ada, http.StatusOK, "ada@example.com"},
+		{"cn", CertMapCN, &noEmail, http.StatusOK, "ada@example.com"},
+		{"no certificate", CertMapEmail, nil, http.StatusUnauthorized, errNoClientCert.Error()},
+		{"no email", CertMapEmail, &noEmail, http.StatusUnauthorized, "client certificate has no email SAN"},
+		{"unknown user", CertMapEmail, &unknown, http.StatusUnauthorized, "no admin user for certificate"},
+		{"disabled user", CertMapCN, &bob, http.StatusUnauthorized, errUserDisabled.Error()},
+		// the client only sends a certificate issued by the CAs of the server
+		{"untrusted CA", CertMapEmail, &untrusted, http.StatusUnauthorized, errNoClientCert.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCertConfig(ClientCertConfig{CAFile: ca.file(t), Mapping: tt.mapping})
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := certServer(t, &auth{db: db, cert: c}, ca)
+			status, body := get(t, srv, ca, tt.cert)
+			if status != tt.status || !strings.HasPrefix(body, tt.body) {
+				t.Errorf("got %d %q, want %d %q", status, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+// fakeDirectory returns its entry at the DN, or for every DN when dn is
+// empty, and by uid. It counts the lookups.
+type fakeDirectory struct {
+	ldap.Client
+	entry   ldap.Entry
+	dn      string
+	lookups *int
+}
+
+func (d fakeDirectory) LookupDN(dn string) (ldap.Entry, error) {
+	*d.lookups++
+	if d.dn != "" && d.dn != dn {
+		return ldap.Entry{}, errors.New("not found")
+	}
+	e := d.entry
+	e.DN = dn
+	return e, nil
+}
+
+func (d fakeDirectory) Lookup(username string) (ldap.Entry, error) {
+	*d.lookups++
+	if username != d.entry.UID {
+		return ldap.Entry{}, errors.New("not found")
+	}
+	e := d.entry
+	e.DN = d.dn
+	return e, nil
+}
+
+func TestCertUserLDAP(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	cert := ca.client(t, "ada", "")
+	tests := []struct {
+		name   string
+		entry  ldap.Entry
+		dn     string
+		status int
+		body   string
+	}{
+		{"created", ldap.Entry{UID: "ada", Mail: "ada@example.com", GivenName: "Ada"}, "", http.StatusOK, "ada@example.com"},
+		{"other DN format", ldap.Entry{UID: "ada", Mail: "ada@example.com"}, "uid=ada,ou=people,o=example", http.StatusOK, "ada@example.com"},
+		{"not in directory", ldap.Entry{UID: "bob", Mail: "bob@example.com"}, "uid=bob,ou=people,o=example", http.StatusUnauthorized, "no directory entry for certificate CN=ada,O=Example: not found"},
+		{"no mail", ldap.Entry{UID: "ada"}, "", http.StatusUnauthorized, "directory entry CN=ada,O=Example has no mail attribute"},
+		{"no uid", ldap.Entry{Mail: "ada@example.com"}, "", http.StatusUnauthorized, "directory entry CN=ada,O=Example has no uid attribute"},
+		{"disabled in directory", ldap.Entry{UID: "ada", Mail: "ada@example.com", Disabled: true}, "", http.StatusUnauthorized, errUserDisabled.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			c, err := newCertConfig(ClientCertConfig{CAFile: ca.file(t)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.mapping, c.ldap = CertMapLDAP, fakeDirectory{entry: tt.entry, dn: tt.dn, lookups: new(int)}
+			srv := certServer(t, &auth{db: db, cert: c}, ca)
+			status, body := get(t, srv, ca, &cert)
+			if status != tt.status || body != tt.body {
+				t.Errorf("got %d %q, want %d %q", status, body, tt.status, tt.body)
+			}
+
+			var count int
+			db.Model(&adminUser{}).Count(&count)
+			if want := map[bool]int{true: 1, false: 0}[tt.status == http.StatusOK]; count != want {
+				t.Errorf("%d users created, want %d", count, want)
+			}
+		})
+	}
+}
+
+func TestCertUserLDAPCache(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	cert := ca.client(t, "ada", "")
+	db := testDB(t)
+	c, err := newCertConfig(ClientCertConfig{CAFile: ca.file(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookups := 0
+	c.mapping, c.ldap = CertMapLDAP, fakeDirectory{entry: ldap.Entry{UID: "ada", Mail: "ada@example.com"}, lookups: &lookups}
+	srv := certServer(t, &auth{db: db, cert: c}, ca)
+
+	if status, body := get(t, srv, ca, &cert); status != http.StatusOK {
+		t.Fatalf("got %d %q", status, body)
+	}
+	var first adminUser
+	db.First(&first)
+	for i := 0; i < 3; i++ {
+		if status, body := get(t, srv, ca, &cert); status != http.StatusOK {
+			t.Fatalf("got %d %q", status, body)
+		}
+	}
+	var last adminUser
+	db.First(&last)
+	if lookups != 1 {
+		t.Errorf("%d directory lookups, want 1", lookups)
+	}
+	if !last.UpdatedAt.Equal(first.UpdatedAt) {
+		t.Errorf("the user was written again at %v", last.UpdatedAt)
+	}
+}
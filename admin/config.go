@@ -0,0 +1,589 @@
+package admin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"qor-admin-3/admin/ldap"
+	"qor-admin-3/admin/mail"
+	"qor-admin-3/admin/tracing"
+	"qor-admin-3/models"
+)
+
+// envPrefix is the prefix of the environment variables overriding the
+// configuration, ex. QOR_LDAP_HOST for ldap.host
+const envPrefix = "QOR"
+
+// tablePrefix matches the characters DynamoDB allows in table names
+var tablePrefix = regexp.MustCompile(`^[a-zA-Z0-9_.-]*$`)
+
+// Config holds every setting of the admin and the server running it
+type Config struct {
+	Listen       string         `yaml:"listen" toml:"listen"`               // address of the HTTP server, ex. "127.0.0.1:8080"
+	Prefix       string         `yaml:"prefix" toml:"prefix"`               // prefix of the admin routes, can be empty
+	SiteName     string         `yaml:"site_name" toml:"site_name"`         // title of the admin interface
+	CookieSecret string         `yaml:"cookie_secret" toml:"cookie_secret"` // encrypts the session cookie
+	Database     DatabaseConfig `yaml:"database" toml:"database"`
+	DynamoDB     DynamoDBConfig `yaml:"dynamodb" toml:"dynamodb"`
+	LDAP         LDAPConfig     `yaml:"ldap" toml:"ldap"`
+	Server       ServerConfig   `yaml:"server" toml:"server"`
+	Health       HealthConfig   `yaml:"health" toml:"health"`
+	Metrics      MetricsConfig  `yaml:"metrics" toml:"metrics"`
+	Log          LogConfig      `yaml:"log" toml:"log"`
+	Tracing      TracingConfig  `yaml:"tracing" toml:"tracing"`
+	// LocalAccounts enables the accounts created by the user create and seed
+	// commands, see UseLocalAccounts
+	LocalAccounts AccountsConfig `yaml:"local_accounts" toml:"local_accounts"`
+	// ProxyAuth and ClientCert replace the login form, see UseProxyAuth and
+	// UseClientCertAuth. Only one of them can be enabled.
+	ProxyAuth  ProxyConfig        `yaml:"proxy_auth" toml:"proxy_auth"`
+	ClientCert CertAuthConfig     `yaml:"client_cert" toml:"client_cert"`
+	SCIM       ProvisioningConfig `yaml:"scim" toml:"scim"`
+	LDAPSync   SyncConfig         `yaml:"ldap_sync" toml:"ldap_sync"`
+}
+
+// ProxyConfig configures the authentication by a trusted reverse proxy. The
+// group_roles map can't be set from the environment.
+type ProxyConfig struct {
+	Enabled      bool              `yaml:"enabled" toml:"enabled"`
+	UserHeader   string            `yaml:"user_header" toml:"user_header"`     // defaults to "X-Forwarded-User"
+	GroupsHeader string            `yaml:"groups_header" toml:"groups_header"` // defaults to "X-Forwarded-Groups"
+	EmailDomain  string            `yaml:"email_domain" toml:"email_domain"`   // ex. "example.com"
+	TrustedCIDRs []string          `yaml:"trusted_cidrs" toml:"trusted_cidrs"` // networks of the proxy
+	GroupRoles   map[string]string `yaml:"group_roles" toml:"group_roles"`     // proxy group to admin role
+	LoginURL     string            `yaml:"login_url" toml:"login_url"`
+	LogoutURL    string            `yaml:"logout_url" toml:"logout_url"`
+}
+
+// CertAuthConfig configures the authentication by client certificates, it
+// requires the server TLS settings. The ldap mapping uses the ldap section.
+type CertAuthConfig struct {
+	Enabled  bool   `yaml:"enabled" toml:"enabled"`
+	CAFile   string `yaml:"ca_file" toml:"ca_file"`   // PEM bundle of the client CAs
+	Required bool   `yaml:"required" toml:"required"` // reject the connections without a certificate
+	Mapping  string `yaml:"mapping" toml:"mapping"`   // "email", "cn" or "ldap"
+}
+
+// ProvisioningConfig enables the provisioning of the users and groups by an
+// identity provider
+type ProvisioningConfig struct {
+	Enabled bool   `yaml:"enabled" toml:"enabled"`
+	Token   string `yaml:"token" toml:"token"` // bearer token of the identity provider
+}
+
+// SyncConfig configures the scheduled synchronisation of the users with the
+// directory of the ldap section. The group_roles map can't be set from the
+// environment.
+type SyncConfig struct {
+	Enabled    bool              `yaml:"enabled" toml:"enabled"`
+	Interval   time.Duration     `yaml:"interval" toml:"interval"`
+	GroupRoles map[string]string `yaml:"group_roles" toml:"group_roles"` // directory group (cn) to admin role
+	DryRun     bool              `yaml:"dry_run" toml:"dry_run"`         // only report the changes
+}
+
+// AccountsConfig configures the local accounts and the delivery of their
+// invitation and password reset emails, through SMTP or to a directory
+type AccountsConfig struct {
+	Enabled      bool          `yaml:"enabled" toml:"enabled"`
+	BaseURL      string        `yaml:"base_url" toml:"base_url"`   // public URL of the admin used in the emails
+	From         string        `yaml:"from" toml:"from"`           // sender address of the emails
+	SMTPHost     string        `yaml:"smtp_host" toml:"smtp_host"` // ex. "smtp.example.com:587"
+	SMTPUsername string        `yaml:"smtp_username" toml:"smtp_username"`
+	SMTPPassword string        `yaml:"smtp_password" toml:"smtp_password"`
+	MailDir      string        `yaml:"mail_dir" toml:"mail_dir"` // writes the emails as .eml files instead, for local development
+	InviteTTL    time.Duration `yaml:"invite_ttl" toml:"invite_ttl"`
+	ResetTTL     time.Duration `yaml:"reset_ttl" toml:"reset_ttl"`
+}
+
+// TracingConfig selects the OpenTelemetry exporter, see tracing.Setup
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter"`         // "none", "stdout", "file" or "otlp"
+	File        string  `yaml:"file" toml:"file"`                 // output of the file exporter
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint"`         // OTLP/HTTP collector, ex. "otel-collector:4318"
+	Insecure    bool    `yaml:"insecure" toml:"insecure"`         // OTLP without TLS
+	ServiceName string  `yaml:"service_name" toml:"service_name"` // service.name of the spans
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"` // share of the traces recorded
+}
+
+// LogConfig configures the logs, see logging.Configure. The level can be
+// changed while running with PUT /loglevel.
+type LogConfig struct {
+	Level  string `yaml:"level" toml:"level"`   // ex. "info", "debug"
+	Format string `yaml:"format" toml:"format"` // "json" or "text"
+}
+
+// MetricsConfig restricts the access to /metrics and /loglevel. On the
+// admin listener it's granted to the signed in users holding Role and to the
+// requests coming from TrustedCIDRs. Behind a reverse proxy every request
+// comes from the proxy, so the scrapers should rather use Listen.
+type MetricsConfig struct {
+	TrustedCIDRs []string `yaml:"trusted_cidrs" toml:"trusted_cidrs"` // none by default
+	Role         string   `yaml:"role" toml:"role"`                   // ex. "monitoring", none by default
+	Listen       string   `yaml:"listen" toml:"listen"`               // separate address serving them to anyone, ex. "127.0.0.1:9090"
+}
+
+// HealthConfig configures the readiness checks of /readyz
+type HealthConfig struct {
+	Timeout  time.Duration `yaml:"timeout" toml:"timeout"`     // maximum duration of a check
+	CacheTTL time.Duration `yaml:"cache_ttl" toml:"cache_ttl"` // a result is reused for this long
+}
+
+// ServerConfig holds the HTTP server timeouts and TLS settings. TLS is
+// enabled when both TLSCert and TLSKey are set.
+type ServerConfig struct {
+	ReadTimeout     time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"` // time given to in-flight requests on shutdown
+	TLSCert         string        `yaml:"tls_cert" toml:"tls_cert"`                 // PEM certificate file
+	TLSKey          string        `yaml:"tls_key" toml:"tls_key"`                   // PEM private key file
+}
+
+// TLS reports if the server must be started with TLS
+func (c ServerConfig) TLS() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// DatabaseConfig holds the gorm connection settings
+type DatabaseConfig struct {
+	Dialect string `yaml:"dialect" toml:"dialect"` // ex. "sqlite3"
+	DSN     string `yaml:"dsn" toml:"dsn"`         // ex. ":memory:"
+}
+
+// DynamoDBConfig holds the DynamoDB connection settings. Without static keys
+// the credentials come from the default chain: the AWS_* environment
+// variables, the shared files with the profile, then the role of the
+// instance or the task.
+type DynamoDBConfig struct {
+	Region          string `yaml:"region" toml:"region"`
+	Endpoint        string `yaml:"endpoint" toml:"endpoint"` // only needed for DynamoDB Local
+	AccessKeyID     string `yaml:"access_key_id" toml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key" toml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token" toml:"session_token"`
+	Profile         string `yaml:"profile" toml:"profile"`
+	TablePrefix     string `yaml:"table_prefix" toml:"table_prefix"` // ex. "staging-", prepended to every table
+	// Timeout bounds a call including its retries, ConnectTimeout the
+	// connection. MaxRetries applies to the throttled and failed calls.
+	Timeout        time.Duration `yaml:"timeout" toml:"timeout"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout" toml:"connect_timeout"`
+	MaxRetries     int           `yaml:"max_retries" toml:"max_retries"`
+	// Provision creates or updates the tables and applies their migrations
+	// when the server starts, like the migrate command
+	Provision bool `yaml:"provision" toml:"provision"`
+	// TrashRetention is how long the soft deleted items are kept before they
+	// are purged by the server, forever when zero
+	TrashRetention time.Duration `yaml:"trash_retention" toml:"trash_retention"`
+}
+
+// LDAPConfig holds the directory used to authenticate the users
+type LDAPConfig struct {
+	Host         string `yaml:"host" toml:"host"`       // ex. "ldap.directory.com:389"
+	BaseDN       string `yaml:"base_dn" toml:"base_dn"` // ex. "dc=example,dc=com"
+	Filter       string `yaml:"filter" toml:"filter"`   // login attribute, ex. "uid"
+	BindDN       string `yaml:"bind_dn" toml:"bind_dn"` // read-only user
+	BindPassword string `yaml:"bind_password" toml:"bind_password"`
+}
+
+// ConfigErrors lists every invalid or missing setting
+type ConfigErrors []string
+
+func (errs ConfigErrors) Error() string {
+	return fmt.Sprintf("[CONFIG] %d invalid setting(s):\n  - %s", len(errs), strings.Join(errs, "\n  - "))
+}
+
+// DefaultConfig returns the settings used when nothing is configured. The
+// cookie secret, the directory and its bind account have no default and must
+// be configured, see config.example.yml for a local setup.
+func DefaultConfig() Config {
+	return Config{
+		Listen: "127.0.0.1:8080",
+		Server: ServerConfig{
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Health:   HealthConfig{Timeout: 2 * time.Second, CacheTTL: 5 * time.Second},
+		Log:      LogConfig{Level: "info", Format: "json"},
+		Tracing:  TracingConfig{Exporter: tracing.ExporterNone, ServiceName: "qor-admin", SampleRatio: 1},
+		SiteName: "My Admin Interface",
+		Database: DatabaseConfig{Dialect: "sqlite3", DSN: ":memory:"},
+		DynamoDB: DynamoDBConfig{
+			Region:         "us-west-2",
+			Timeout:        10 * time.Second,
+			ConnectTimeout: 3 * time.Second,
+			MaxRetries:     10,
+			TrashRetention: 30 * 24 * time.Hour,
+		},
+		LDAP:          LDAPConfig{Filter: "uid"},
+		LocalAccounts: AccountsConfig{InviteTTL: 72 * time.Hour, ResetTTL: time.Hour},
+		ClientCert:    CertAuthConfig{Mapping: CertMapEmail},
+		LDAPSync:      SyncConfig{Interval: time.Hour},
+	}
+}
+
+// LoadConfig reads the configuration from a YAML or TOML file, chosen by its
+// extension, then from the QOR_* environment variables. The path can be
+// empty to only use the defaults and the environment. The returned error is
+// a ConfigErrors when settings are invalid.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			err = yaml.UnmarshalStrict(content, &cfg)
+		case ".toml":
+			// like the yaml, the unknown keys are rejected
+			var md toml.MetaData
+			if md, err = toml.Decode(string(content), &cfg); err == nil {
+				if undecoded := md.Undecoded(); len(undecoded) > 0 {
+					err = fmt.Errorf("unknown key %q", undecoded[0].String())
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown configuration format %q, use .yaml or .toml", filepath.Ext(path))
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("[CONFIG] %s: %v", path, err)
+		}
+	}
+
+	var errs ConfigErrors
+	errs = append(errs, loadEnv(reflect.ValueOf(&cfg).Elem(), envPrefix)...)
+	errs = append(errs, cfg.Validate()...)
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// loadEnv overrides the fields of v with the environment variables named
+// after their yaml tags
+func loadEnv(v reflect.Value, prefix string) ConfigErrors {
+	var errs ConfigErrors
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			errs = append(errs, loadEnv(fv, name)...)
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a boolean", name, value))
+				continue
+			}
+			fv.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			if fv.Type() == reflect.TypeOf(time.Duration(0)) {
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %q is not a duration", name, value))
+					continue
+				}
+				fv.SetInt(int64(d))
+				continue
+			}
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a number", name, value))
+				continue
+			}
+			fv.SetInt(n)
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a number", name, value))
+				continue
+			}
+			fv.SetFloat(f)
+		case reflect.Slice:
+			if fv.Type().Elem().Kind() == reflect.String {
+				fv.Set(reflect.ValueOf(strings.Split(value, ",")))
+			}
+		}
+	}
+	return errs
+}
+
+// Validate checks every setting and returns all the problems found
+func (cfg Config) Validate() ConfigErrors {
+	var errs ConfigErrors
+	required := func(name, value string) {
+		if strings.TrimSpace(value) == "" {
+			errs = append(errs, fmt.Sprintf("%s is required", name))
+		}
+	}
+
+	required("listen", cfg.Listen)
+	if cfg.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+			errs = append(errs, fmt.Sprintf("listen: %v", err))
+		}
+	}
+	positive := func(name string, d time.Duration) {
+		if d <= 0 {
+			errs = append(errs, fmt.Sprintf("%s must be positive", name))
+		}
+	}
+	readable := func(name, file string) {
+		if file == "" {
+			return
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	groupRoles := func(name string, m map[string]string) {
+		for group, role := range m {
+			if strings.TrimSpace(group) == "" || strings.TrimSpace(role) == "" {
+				errs = append(errs, fmt.Sprintf("%s: %q: %q has an empty group or role", name, group, role))
+			}
+		}
+	}
+	positive("server.read_timeout", cfg.Server.ReadTimeout)
+	positive("server.write_timeout", cfg.Server.WriteTimeout)
+	positive("server.idle_timeout", cfg.Server.IdleTimeout)
+	positive("server.shutdown_timeout", cfg.Server.ShutdownTimeout)
+	positive("health.timeout", cfg.Health.Timeout)
+	if cfg.Health.CacheTTL < 0 {
+		errs = append(errs, "health.cache_ttl can't be negative")
+	}
+	if _, err := logrus.ParseLevel(cfg.Log.Level); err != nil {
+		errs = append(errs, fmt.Sprintf("log.level: %v", err))
+	}
+	if cfg.Log.Format != "json" && cfg.Log.Format != "text" {
+		errs = append(errs, fmt.Sprintf("log.format: %q is not json or text", cfg.Log.Format))
+	}
+	switch cfg.Tracing.Exporter {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	case tracing.ExporterFile:
+		required("tracing.file", cfg.Tracing.File)
+	default:
+		errs = append(errs, fmt.Sprintf("tracing.exporter: %q is not none, stdout, file or otlp", cfg.Tracing.Exporter))
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		errs = append(errs, "tracing.sample_ratio must be between 0 and 1")
+	}
+	if cfg.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Metrics.Listen); err != nil {
+			errs = append(errs, fmt.Sprintf("metrics.listen: %v", err))
+		} else if cfg.Metrics.Listen == cfg.Listen {
+			errs = append(errs, "metrics.listen must differ from listen")
+		}
+	}
+	for _, cidr := range cfg.Metrics.TrustedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Sprintf("metrics.trusted_cidrs: %v", err))
+		}
+	}
+	if (cfg.Server.TLSCert == "") != (cfg.Server.TLSKey == "") {
+		errs = append(errs, "server.tls_cert and server.tls_key must be set together")
+	}
+	readable("server.tls_cert", cfg.Server.TLSCert)
+	readable("server.tls_key", cfg.Server.TLSKey)
+	if cfg.Prefix != "" && !strings.HasPrefix(cfg.Prefix, "/") {
+		errs = append(errs, "prefix must start with a /")
+	}
+	required("site_name", cfg.SiteName)
+	required("cookie_secret", cfg.CookieSecret)
+	required("database.dialect", cfg.Database.Dialect)
+	required("database.dsn", cfg.Database.DSN)
+	required("dynamodb.region", cfg.DynamoDB.Region)
+	if cfg.DynamoDB.Endpoint != "" {
+		if u, err := url.Parse(cfg.DynamoDB.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("dynamodb.endpoint: %q is not a valid URL", cfg.DynamoDB.Endpoint))
+		}
+	}
+	if (cfg.DynamoDB.AccessKeyID == "") != (cfg.DynamoDB.SecretAccessKey == "") {
+		errs = append(errs, "dynamodb.access_key_id and dynamodb.secret_access_key must be set together")
+	}
+	if cfg.DynamoDB.AccessKeyID != "" && cfg.DynamoDB.Profile != "" {
+		errs = append(errs, "dynamodb.profile can't be used with static keys")
+	}
+	if !tablePrefix.MatchString(cfg.DynamoDB.TablePrefix) {
+		errs = append(errs, fmt.Sprintf("dynamodb.table_prefix: %q may only contain letters, digits, _, - and .", cfg.DynamoDB.TablePrefix))
+	}
+	positive("dynamodb.timeout", cfg.DynamoDB.Timeout)
+	positive("dynamodb.connect_timeout", cfg.DynamoDB.ConnectTimeout)
+	if cfg.DynamoDB.MaxRetries < 1 {
+		errs = append(errs, "dynamodb.max_retries must be positive")
+	}
+	if cfg.DynamoDB.TrashRetention < 0 {
+		errs = append(errs, "dynamodb.trash_retention can't be negative")
+	}
+	required("ldap.host", cfg.LDAP.Host)
+	if cfg.LDAP.Host != "" {
+		if _, _, err := net.SplitHostPort(cfg.LDAP.Host); err != nil {
+			errs = append(errs, fmt.Sprintf("ldap.host: %v", err))
+		}
+	}
+	required("ldap.base_dn", cfg.LDAP.BaseDN)
+	required("ldap.filter", cfg.LDAP.Filter)
+	required("ldap.bind_dn", cfg.LDAP.BindDN)
+	required("ldap.bind_password", cfg.LDAP.BindPassword)
+	if cfg.LocalAccounts.Enabled {
+		required("local_accounts.base_url", cfg.LocalAccounts.BaseURL)
+		if u, err := url.Parse(cfg.LocalAccounts.BaseURL); cfg.LocalAccounts.BaseURL != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+			errs = append(errs, fmt.Sprintf("local_accounts.base_url: %q is not a valid URL", cfg.LocalAccounts.BaseURL))
+		}
+		required("local_accounts.from", cfg.LocalAccounts.From)
+		if (cfg.LocalAccounts.SMTPHost == "") == (cfg.LocalAccounts.MailDir == "") {
+			errs = append(errs, "local_accounts: set either smtp_host or mail_dir")
+		}
+		positive("local_accounts.invite_ttl", cfg.LocalAccounts.InviteTTL)
+		positive("local_accounts.reset_ttl", cfg.LocalAccounts.ResetTTL)
+	}
+	if cfg.ProxyAuth.Enabled {
+		if len(cfg.ProxyAuth.TrustedCIDRs) == 0 {
+			errs = append(errs, "proxy_auth.trusted_cidrs is required")
+		}
+		for _, cidr := range cfg.ProxyAuth.TrustedCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				errs = append(errs, fmt.Sprintf("proxy_auth.trusted_cidrs: %v", err))
+			}
+		}
+		groupRoles("proxy_auth.group_roles", cfg.ProxyAuth.GroupRoles)
+		if cfg.ClientCert.Enabled {
+			errs = append(errs, "proxy_auth and client_cert can't be enabled together")
+		}
+	}
+	if cfg.ClientCert.Enabled {
+		required("client_cert.ca_file", cfg.ClientCert.CAFile)
+		readable("client_cert.ca_file", cfg.ClientCert.CAFile)
+		if !cfg.Server.TLS() {
+			errs = append(errs, "client_cert requires server.tls_cert and server.tls_key")
+		}
+		switch cfg.ClientCert.Mapping {
+		case CertMapEmail, CertMapCN, CertMapLDAP:
+		default:
+			errs = append(errs, fmt.Sprintf("client_cert.mapping: %q is not email, cn or ldap", cfg.ClientCert.Mapping))
+		}
+	}
+	if cfg.SCIM.Enabled {
+		required("scim.token", cfg.SCIM.Token)
+	}
+	if cfg.LDAPSync.Enabled {
+		positive("ldap_sync.interval", cfg.LDAPSync.Interval)
+		groupRoles("ldap_sync.group_roles", cfg.LDAPSync.GroupRoles)
+	}
+	return errs
+}
+
+// LDAP returns the configuration of the ldap package
+func (c LDAPConfig) LDAP() ldap.Config {
+	return ldap.Config{
+		BaseDN: c.BaseDN,
+		Filter: c.Filter,
+		ROUser: ldap.User{Name: c.BindDN, Pass: c.BindPassword},
+		Host:   c.Host,
+	}
+}
+
+// LocalAccounts returns the configuration of UseLocalAccounts
+func (c AccountsConfig) LocalAccounts() (LocalAccountsConfig, error) {
+	cfg := LocalAccountsConfig{BaseURL: c.BaseURL, From: c.From, InviteTTL: c.InviteTTL, ResetTTL: c.ResetTTL}
+	if c.MailDir != "" {
+		cfg.Sender = mail.FileSender{Dir: c.MailDir}
+		return cfg, nil
+	}
+	sender, err := mail.NewSMTPSender(mail.SMTPConfig{Host: c.SMTPHost, Username: c.SMTPUsername, Password: c.SMTPPassword})
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Sender = sender
+	return cfg, nil
+}
+
+// ProxyAuth returns the configuration of UseProxyAuth
+func (c ProxyConfig) ProxyAuth() ProxyAuthConfig {
+	return ProxyAuthConfig{
+		UserHeader:   c.UserHeader,
+		GroupsHeader: c.GroupsHeader,
+		EmailDomain:  c.EmailDomain,
+		TrustedCIDRs: c.TrustedCIDRs,
+		GroupRoles:   c.GroupRoles,
+		LoginURL:     c.LoginURL,
+		LogoutURL:    c.LogoutURL,
+	}
+}
+
+// ClientCert returns the configuration of UseClientCertAuth, the ldap
+// mapping looks the certificates up in the directory
+func (c CertAuthConfig) ClientCert(directory LDAPConfig) ClientCertConfig {
+	cfg := ClientCertConfig{CAFile: c.CAFile, Required: c.Required, Mapping: c.Mapping}
+	if c.Mapping == CertMapLDAP {
+		l := directory.LDAP()
+		cfg.LDAP = &l
+	}
+	return cfg
+}
+
+// SCIM returns the configuration of UseSCIM
+func (c ProvisioningConfig) SCIM() SCIMConfig {
+	return SCIMConfig{Token: c.Token}
+}
+
+// LDAPSync returns the configuration of UseLDAPSync with the directory
+func (c SyncConfig) LDAPSync(directory LDAPConfig) LDAPSyncConfig {
+	return LDAPSyncConfig{LDAP: directory.LDAP(), Interval: c.Interval, GroupRoles: c.GroupRoles, DryRun: c.DryRun}
+}
+
+// Tracing returns the configuration of the tracing package
+func (c TracingConfig) Tracing() tracing.Config {
+	return tracing.Config{
+		Exporter:    c.Exporter,
+		File:        c.File,
+		Endpoint:    c.Endpoint,
+		Insecure:    c.Insecure,
+		ServiceName: c.ServiceName,
+		SampleRatio: c.SampleRatio,
+	}
+}
+
+// Models returns the configuration of the models package
+func (c DynamoDBConfig) Models() models.DynamoDBConfig {
+	return models.DynamoDBConfig{
+		Region:          c.Region,
+		Endpoint:        c.Endpoint,
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		Profile:         c.Profile,
+		TablePrefix:     c.TablePrefix,
+		Timeout:         c.Timeout,
+		ConnectTimeout:  c.ConnectTimeout,
+		MaxRetries:      c.MaxRetries,
+	}
+}
@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// minimalYAML holds the settings without defaults
+const minimalYAML = `
+cookie_secret: "secret"
+ldap:
+  host: "ldap.example.com:389"
+  base_dn: "dc=example,dc=com"
+  bind_dn: "cn=reader,dc=example,dc=com"
+  bind_password: "password"
+`
+
+const minimalTOML = `
+cookie_secret = "secret"
+[ldap]
+host = "ldap.example.com:389"
+base_dn = "dc=example,dc=com"
+bind_dn = "cn=reader,dc=example,dc=com"
+bind_password = "password"
+`
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string // name of the configuration file, none when empty
+		content string
+		env     map[string]string
+		err     string // expected in the error, none when empty
+		check   func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "yaml", file: "config.yml", content: minimalYAML + "listen: \"0.0.0.0:80\"\n",
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Listen != "0.0.0.0:80" || cfg.LDAP.Host != "ldap.example.com:389" || cfg.SiteName != DefaultConfig().SiteName {
+					t.Errorf("got %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "toml", file: "config.toml", content: "listen = \"0.0.0.0:80\"\n" + minimalTOML + "[dynamodb]\ntimeout = \"5s\"\n",
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Listen != "0.0.0.0:80" || cfg.LDAP.BindPassword != "password" || cfg.DynamoDB.Timeout != 5*time.Second {
+					t.Errorf("got %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "environment only",
+			env: map[string]string{
+				"QOR_COOKIE_SECRET": "secret", "QOR_LDAP_HOST": "ldap.example.com:389", "QOR_LDAP_BASE_DN": "dc=example,dc=com",
+				"QOR_LDAP_BIND_DN": "cn=reader", "QOR_LDAP_BIND_PASSWORD": "password",
+			},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.CookieSecret != "secret" || cfg.LDAP.BindDN != "cn=reader" {
+					t.Errorf("got %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "environment overrides the file", file: "config.yml", content: minimalYAML,
+			env: map[string]string{
+				"QOR_LISTEN": "0.0.0.0:80", "QOR_DYNAMODB_TIMEOUT": "3s", "QOR_DYNAMODB_MAX_RETRIES": "2",
+				"QOR_METRICS_TRUSTED_CIDRS": "10.0.0.0/8,127.0.0.1/32", "QOR_LOCAL_ACCOUNTS_ENABLED": "false",
+			},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Listen != "0.0.0.0:80" || cfg.DynamoDB.Timeout != 3*time.Second || cfg.DynamoDB.MaxRetries != 2 ||
+					len(cfg.Metrics.TrustedCIDRs) != 2 || cfg.CookieSecret != "secret" {
+					t.Errorf("got %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "invalid environment", file: "config.yml", content: minimalYAML,
+			env: map[string]string{"QOR_DYNAMODB_TIMEOUT": "soon", "QOR_SCIM_ENABLED": "maybe"},
+			err: "QOR_DYNAMODB_TIMEOUT: \"soon\" is not a duration",
+		},
+		{name: "unknown yaml key", file: "config.yml", content: minimalYAML + "lisen: \":80\"\n", err: "lisen"},
+		{name: "unknown toml key", file: "config.toml", content: minimalTOML + "[server]\nread_timeot = \"1s\"\n", err: "server.read_timeot"},
+		{name: "unknown format", file: "config.json", content: "{}", err: "unknown configuration format"},
+		{name: "required", err: "cookie_secret is required"},
+		{name: "required directory", file: "config.yml", content: "cookie_secret: \"secret\"\n", err: "ldap.bind_password is required"},
+		{
+			name: "sections", file: "config.yml",
+			content: minimalYAML + `
+proxy_auth:
+  enabled: true
+  trusted_cidrs: ["10.0.0.0/8"]
+  group_roles:
+    admins: "admin"
+scim:
+  enabled: true
+  token: "token"
+ldap_sync:
+  enabled: true
+  interval: "30m"
+  group_roles:
+    editors: "editor"
+`,
+			check: func(t *testing.T, cfg Config) {
+				if !cfg.ProxyAuth.Enabled || cfg.ProxyAuth.GroupRoles["admins"] != "admin" || cfg.SCIM.SCIM().Token != "token" {
+					t.Errorf("got %+v", cfg)
+				}
+				sync := cfg.LDAPSync.LDAPSync(cfg.LDAP)
+				if sync.Interval != 30*time.Minute || sync.GroupRoles["editors"] != "editor" || sync.LDAP.Host != "ldap.example.com:389" {
+					t.Errorf("got %+v", sync)
+				}
+			},
+		},
+		{
+			name: "invalid sections", file: "config.yml",
+			content: minimalYAML + `
+proxy_auth:
+  enabled: true
+  trusted_cidrs: ["10.0.0.0"]
+client_cert:
+  enabled: true
+  mapping: "uid"
+scim:
+  enabled: true
+ldap_sync:
+  enabled: true
+  group_roles:
+    editors: ""
+`,
+			err: "proxy_auth.trusted_cidrs",
+			check: func(t *testing.T, cfg Config) {
+				errs := cfg.Validate()
+				for _, want := range []string{
+					"proxy_auth and client_cert can't be enabled together",
+					"client_cert.ca_file is required",
+					"client_cert requires server.tls_cert and server.tls_key",
+					"client_cert.mapping: \"uid\"",
+					"scim.token is required",
+					"ldap_sync.group_roles",
+				} {
+					if !strings.Contains(errs.Error(), want) {
+						t.Errorf("%q missing from %v", want, errs)
+					}
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var path string
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), tt.file)
+				if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg, err := LoadConfig(path)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("got %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+			if tt.check != nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	if _, err := LoadConfig(filepath.Join("..", "config.example.yml")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,532 @@
+package dynamo
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+	"github.com/sirupsen/logrus"
+
+	"qor-admin-3/admin/logging"
+)
+
+const (
+	// batchWriteSize is the most writes of a BatchWriteItem call
+	batchWriteSize = 25
+	// batchGetSize is the most keys of a BatchGetItem call
+	batchGetSize = 100
+	// batchAttempts bounds the calls made for a group of a batch, the
+	// unprocessed items are retried after batchBackoff, doubled every time
+	batchAttempts = 5
+	batchBackoff  = 50 * time.Millisecond
+)
+
+// errUnprocessed is the error of the items DynamoDB still left unprocessed
+// after every attempt
+var errUnprocessed = &RetryableError{Err: errors.New("dynamo: the item was left unprocessed by the batch")}
+
+// BatchResult is the outcome of a batch for one record
+type BatchResult struct {
+	ID  string
+	Err error // nil on success
+}
+
+// BatchDelete removes the records for good, even with soft deletes. The
+// records which don't exist are ignored.
+func (db *DB) BatchDelete(ctx context.Context, t *Table, ids []string) []BatchResult {
+	ids = unique(ids)
+	results := map[string]error{}
+	writes := map[string]*dynamodb.WriteRequest{}
+	for _, id := range ids {
+		key := t.key(id)
+		if key == nil {
+			results[id] = gorm.ErrRecordNotFound
+			continue
+		}
+		writes[id] = &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: key}}
+	}
+	db.batchWrite(ctx, t, "BatchDelete", ids, writes, results)
+	return batchResults(ids, results)
+}
+
+// BatchTrash soft deletes the records on behalf of the user by, with one
+// conditional UpdateItem each like Trash: BatchWriteItem can't check that a
+// record still exists and isn't in the trash.
+func (db *DB) BatchTrash(ctx context.Context, t *Table, ids []string, by string) []BatchResult {
+	ids = unique(ids)
+	results := map[string]error{}
+	for _, id := range ids {
+		results[id] = db.Trash(ctx, t, id, by)
+	}
+	return batchResults(ids, results)
+}
+
+// BatchUpdate sets the field, its Go or attribute name, of the records to
+// the value, converted like the filter values. An empty value clears it. The
+// records are read then saved like with the forms: validate, if not nil,
+// checks each record before it's saved and a record saved in between gets a
+// ConflictError.
+func (db *DB) BatchUpdate(ctx context.Context, t *Table, ids []string, name, value, by string, validate func(record interface{}) error) ([]BatchResult, error) {
+	f, ok := t.updatable(name)
+	if !ok {
+		return nil, fmt.Errorf("dynamo: %s can't be updated in a batch", name)
+	}
+	fc, _ := t.codec.field(f.name)
+	var av *dynamodb.AttributeValue
+	if value != "" {
+		var err error
+		if av, err = t.attributeValue(f, value, false); err != nil {
+			return nil, err
+		}
+		// the value must fit the field, ex. an int8
+		if err := decodeValue(fc.decode, av, reflect.New(t.typ).Elem().FieldByIndex(f.index)); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.goName, err)
+		}
+	}
+
+	ids = unique(ids)
+	results := map[string]error{}
+	found := db.batchGet(ctx, t, "BatchUpdate", ids, results)
+	for _, id := range ids {
+		item, ok := found[id]
+		if !ok {
+			continue
+		}
+		record := reflect.New(t.typ)
+		if err := t.codec.unmarshal(item, record.Elem()); err != nil {
+			results[id] = fmt.Errorf("dynamo: unable to read the %s item %s: %w", db.name(t), id, err)
+			continue
+		}
+		if err := decodeValue(fc.decode, av, record.Elem().FieldByIndex(f.index)); err != nil {
+			results[id] = err
+			continue
+		}
+		if validate != nil {
+			if err := validate(record.Interface()); err != nil {
+				results[id] = err
+				continue
+			}
+		}
+		results[id] = db.save(ctx, t, record.Interface(), false, by)
+	}
+	return batchResults(ids, results), nil
+}
+
+// updatable returns the field of a batch update, the key, version and soft
+// delete fields are excluded
+func (t *Table) updatable(name string) (field, bool) {
+	f, ok := t.field(name)
+	if !ok || f.kind == "" || f.name == t.hash.name || f.name == t.deletedBy ||
+		(t.version != nil && f.name == t.version.name) || (t.deletedAt != nil && f.name == t.deletedAt.name) {
+		return field{}, false
+	}
+	return f, true
+}
+
+// BatchGet reads the records into result, a pointer to a slice of structs
+// of the table or pointers to them, in the order of the ids. The records in
+// the trash are not found.
+func (db *DB) BatchGet(ctx context.Context, t *Table, ids []string, result interface{}) ([]BatchResult, error) {
+	ids = unique(ids)
+	results := map[string]error{}
+	found := db.batchGet(ctx, t, "BatchGet", ids, results)
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(found))
+	for _, id := range ids {
+		if item, ok := found[id]; ok {
+			items = append(items, item)
+		}
+	}
+	if err := t.codec.unmarshalList(items, result); err != nil {
+		return nil, fmt.Errorf("dynamo: unable to read the %s items: %w", db.name(t), err)
+	}
+	return batchResults(ids, results), nil
+}
+
+// batchGet reads the live items of the records with BatchGetItem calls of up
+// to batchGetSize keys, retrying the unprocessed keys with a backoff. The
+// records which don't exist, are in the trash or can't be read get an error
+// in results instead of an item.
+func (db *DB) batchGet(ctx context.Context, t *Table, handler string, ids []string, results map[string]error) map[string]map[string]*dynamodb.AttributeValue {
+	var keys []map[string]*dynamodb.AttributeValue
+	for _, id := range ids {
+		if key := t.key(id); key != nil {
+			keys = append(keys, key)
+		} else {
+			results[id] = gorm.ErrRecordNotFound
+		}
+	}
+
+	items := map[string]map[string]*dynamodb.AttributeValue{}
+	for len(keys) > 0 {
+		n := batchGetSize
+		if len(keys) < n {
+			n = len(keys)
+		}
+		pending := keys[:n]
+		keys = keys[n:]
+		err := db.retry(ctx, func(last bool) (bool, error) {
+			var out *dynamodb.BatchGetItemOutput
+			err := db.call(ctx, db.name(t), handler, "BatchGetItem", func(ctx context.Context) (cc *dynamodb.ConsumedCapacity, err error) {
+				out, err = db.svc.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+					RequestItems: map[string]*dynamodb.KeysAndAttributes{
+						db.name(t): {Keys: pending, ConsistentRead: aws.Bool(true)},
+					},
+					ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+				})
+				if err != nil {
+					return nil, err
+				}
+				return firstCapacity(out.ConsumedCapacity), nil
+			})
+			if err != nil {
+				return false, err
+			}
+			for _, item := range out.Responses[db.name(t)] {
+				items[t.id(item)] = item
+			}
+			pending = nil
+			if unprocessed := out.UnprocessedKeys[db.name(t)]; unprocessed != nil {
+				pending = unprocessed.Keys
+			}
+			if len(pending) > 0 && last {
+				for _, key := range pending {
+					results[t.id(key)] = errUnprocessed
+				}
+			}
+			return len(pending) > 0, nil
+		})
+		if err != nil {
+			for _, key := range pending {
+				results[t.id(key)] = err
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if item, ok := items[id]; ok && t.deleted(item) {
+			delete(items, id)
+		}
+		if _, ok := items[id]; !ok && results[id] == nil {
+			results[id] = gorm.ErrRecordNotFound
+		}
+	}
+	return items
+}
+
+// batchWrite makes the writes of the records, in the order of the ids, with
+// BatchWriteItem calls of up to batchWriteSize writes. The unprocessed writes
+// are retried with a backoff. The records without a write are skipped, the
+// others get their outcome in results.
+func (db *DB) batchWrite(ctx context.Context, t *Table, handler string, ids []string, writes map[string]*dynamodb.WriteRequest, results map[string]error) {
+	var requests []*dynamodb.WriteRequest
+	for _, id := range ids {
+		if w := writes[id]; w != nil {
+			requests = append(requests, w)
+		}
+	}
+	if len(requests) == 0 {
+		return
+	}
+	defer db.cursors.flush(t.Name)
+
+	for len(requests) > 0 {
+		n := batchWriteSize
+		if len(requests) < n {
+			n = len(requests)
+		}
+		pending := requests[:n]
+		requests = requests[n:]
+		err := db.retry(ctx, func(last bool) (bool, error) {
+			var out *dynamodb.BatchWriteItemOutput
+			err := db.call(ctx, db.name(t), handler, "BatchWriteItem", func(ctx context.Context) (cc *dynamodb.ConsumedCapacity, err error) {
+				out, err = db.svc.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+					RequestItems:           map[string][]*dynamodb.WriteRequest{db.name(t): pending},
+					ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+				})
+				if err != nil {
+					return nil, err
+				}
+				return firstCapacity(out.ConsumedCapacity), nil
+			})
+			if err != nil {
+				return false, err
+			}
+			unprocessed := map[string]bool{}
+			for _, w := range out.UnprocessedItems[db.name(t)] {
+				unprocessed[t.id(writeKey(w))] = true
+			}
+			for _, w := range pending {
+				id := t.id(writeKey(w))
+				switch {
+				case !unprocessed[id]:
+					results[id] = nil
+				case last:
+					results[id] = errUnprocessed
+				}
+			}
+			pending = out.UnprocessedItems[db.name(t)]
+			return len(pending) > 0, nil
+		})
+		if err != nil {
+			for _, w := range pending {
+				results[t.id(writeKey(w))] = err
+			}
+		}
+	}
+}
+
+// retry calls fn until it has nothing left to retry, at most batchAttempts
+// times, waiting batchBackoff then twice longer every time. last is set on
+// the last attempt.
+func (db *DB) retry(ctx context.Context, fn func(last bool) (bool, error)) error {
+	backoff := batchBackoff
+	for attempt := 1; ; attempt++ {
+		again, err := fn(attempt == batchAttempts)
+		if err != nil || !again || attempt == batchAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// id returns the qor resource ID of the item or key
+func (t *Table) id(item map[string]*dynamodb.AttributeValue) string {
+	av := item[t.hash.name]
+	if av == nil {
+		return ""
+	}
+	if av.N != nil {
+		return *av.N
+	}
+	return aws.StringValue(av.S)
+}
+
+// writeKey returns the key written by the request, the item of a put
+// request, whose NULL attributes must be left out, see withoutNulls
+func writeKey(w *dynamodb.WriteRequest) map[string]*dynamodb.AttributeValue {
+	if w.DeleteRequest != nil {
+		return w.DeleteRequest.Key
+	}
+	return w.PutRequest.Item
+}
+
+// firstCapacity returns the capacity of the only table of a batch call
+func firstCapacity(cc []*dynamodb.ConsumedCapacity) *dynamodb.ConsumedCapacity {
+	if len(cc) == 0 {
+		return nil
+	}
+	return cc[0]
+}
+
+// unique returns the ids without the duplicates, BatchGetItem rejects them
+func unique(ids []string) []string {
+	seen := map[string]bool{}
+	list := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			list = append(list, id)
+		}
+	}
+	return list
+}
+
+// batchResults lists the results in the order of the ids
+func batchResults(ids []string, results map[string]error) []BatchResult {
+	list := make([]BatchResult, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, BatchResult{ID: id, Err: results[id]})
+	}
+	return list
+}
+
+// batchUpdate is the argument of the batch update action
+type batchUpdate struct {
+	Field string
+	Value string
+}
+
+// configureBatch adds the batch actions of the resource: delete, move to the
+// trash with soft deletes, export and update a field. Each record gets its
+// outcome in a flash message.
+func (db *DB) configureBatch(res *admin.Resource, t *Table) {
+	deleteLabel := "Delete"
+	if t.deletedAt != nil {
+		deleteLabel = "Delete permanently"
+		res.Action(&admin.Action{
+			Name:  "BatchTrash",
+			Label: "Move to trash",
+			Modes: []string{"batch"},
+			Handler: func(arg *admin.ActionArgument) error {
+				ctx := arg.Context
+				if !res.HasPermission(roles.Delete, ctx.Context) {
+					return roles.ErrPermissionDenied
+				}
+				results := db.BatchTrash(ctx.Request.Context(), t, arg.PrimaryValues, userOf(ctx.Context))
+				return db.reportBatch(ctx, t, "moved to the trash", results)
+			},
+		})
+	}
+	res.Action(&admin.Action{
+		Name:  "BatchDelete",
+		Label: deleteLabel,
+		Modes: []string{"batch"},
+		Handler: func(arg *admin.ActionArgument) error {
+			ctx := arg.Context
+			if !res.HasPermission(roles.Delete, ctx.Context) {
+				return roles.ErrPermissionDenied
+			}
+			return db.reportBatch(ctx, t, "deleted", db.BatchDelete(ctx.Request.Context(), t, arg.PrimaryValues))
+		},
+	})
+	res.Action(&admin.Action{
+		Name:  "Export",
+		Label: "Export CSV",
+		Modes: []string{"batch"},
+		Handler: func(arg *admin.ActionArgument) error {
+			if !res.HasPermission(roles.Read, arg.Context.Context) {
+				return roles.ErrPermissionDenied
+			}
+			return db.export(arg, t)
+		},
+	})
+
+	var updatable []string
+	for _, f := range t.fields {
+		if _, ok := t.updatable(f.goName); ok {
+			updatable = append(updatable, f.goName)
+		}
+	}
+	argument := res.GetAdmin().NewResource(&batchUpdate{})
+	argument.Meta(&admin.Meta{Name: "Field", Type: "select_one", Config: &admin.SelectOneConfig{Collection: updatable}})
+	res.Action(&admin.Action{
+		Name:     "BatchUpdate",
+		Label:    "Update a field",
+		Modes:    []string{"batch"},
+		Resource: argument,
+		Handler: func(arg *admin.ActionArgument) error {
+			ctx := arg.Context
+			if !res.HasPermission(roles.Update, ctx.Context) {
+				return roles.ErrPermissionDenied
+			}
+			update, ok := arg.Argument.(*batchUpdate)
+			if !ok {
+				return fmt.Errorf("unexpected argument %T", arg.Argument)
+			}
+			// the validators of the resource check the records like in the
+			// forms, with the updated field as the only meta value
+			values := &resource.MetaValues{Values: []*resource.MetaValue{{Name: update.Field, Value: update.Value}}}
+			validate := func(record interface{}) error {
+				for _, v := range res.Validators {
+					if err := v.Handler(record, values, ctx.Context); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			results, err := db.BatchUpdate(ctx.Request.Context(), t, arg.PrimaryValues, update.Field, update.Value, userOf(ctx.Context), validate)
+			if err != nil {
+				return validations.NewError(update, "Value", err.Error())
+			}
+			return db.reportBatch(ctx, t, "updated", results)
+		},
+	})
+}
+
+// reportBatch flashes the outcome of a batch action for every record and
+// logs the failures. It fails only if no record succeeded.
+func (db *DB) reportBatch(ctx *admin.Context, t *Table, done string, results []BatchResult) error {
+	table := db.name(t)
+	var failed []BatchResult
+	for _, r := range results {
+		if r.Err == nil {
+			continue
+		}
+		err := report(ctx.Context, table, "Batch action failed for a record", qorError(table, r.Err))
+		failed = append(failed, BatchResult{ID: r.ID, Err: err})
+		ctx.Flash(fmt.Sprintf("%s: %v", r.ID, err), "error")
+	}
+	succeeded := len(results) - len(failed)
+	if succeeded > 0 {
+		ctx.Flash(fmt.Sprintf("%d record(s) %s", succeeded, done), "success")
+	}
+	logging.FromContext(ctx.Request.Context()).WithFields(logrus.Fields{
+		"dynamodb_table": table,
+		"succeeded":      succeeded,
+		"failed":         len(failed),
+	}).Info("Batch action applied")
+	if succeeded == 0 && len(failed) > 0 {
+		return fmt.Errorf("no record could be %s: %w", done, failed[0].Err)
+	}
+	return nil
+}
+
+// export writes the selected records as a CSV file, one column per field.
+// The records which can't be read are left out and logged.
+func (db *DB) export(arg *admin.ActionArgument, t *Table) error {
+	ctx := arg.Context
+	records := reflect.New(reflect.SliceOf(reflect.PtrTo(t.typ)))
+	results, err := db.BatchGet(ctx.Request.Context(), t, arg.PrimaryValues, records.Interface())
+	if err != nil {
+		return report(ctx.Context, db.name(t), "Couldn't export the records", err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			report(ctx.Context, db.name(t), "Couldn't export a record", qorError(db.name(t), r.Err))
+		}
+	}
+
+	w := ctx.Writer
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.ToLower(t.Name)+`.csv"`)
+	arg.SkipDefaultResponse = true
+	out := csv.NewWriter(w)
+	header := make([]string, len(t.fields))
+	for i, f := range t.fields {
+		header[i] = f.goName
+	}
+	out.Write(header)
+	list := records.Elem()
+	for i := 0; i < list.Len(); i++ {
+		row := make([]string, len(t.fields))
+		for j, f := range t.fields {
+			row[j] = csvValue(list.Index(i).Elem().FieldByIndex(f.index))
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// csvValue formats a field for the export, the times in RFC 3339
+func csvValue(v reflect.Value) string {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if d, ok := v.Interface().(time.Time); ok {
+		if d.IsZero() {
+			return ""
+		}
+		return d.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,467 @@
+package dynamo
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// codec converts the structs of a type to and from attribute maps, in the
+// format of dynamodbattribute so the items written before are still read.
+// The fields are planned once per type, see codecOf, instead of being
+// reflected on for every item.
+type codec struct {
+	typ    reflect.Type
+	fields []fieldCodec
+}
+
+// fieldCodec is the plan of a stored field
+type fieldCodec struct {
+	index     []int
+	name      string // attribute name
+	path      string // for the errors, ex. "Customer.Name"
+	omitEmpty bool
+	encode    encoder
+	decode    decoder
+}
+
+// encoder returns the attribute value of v, NULL for the empty values
+type encoder func(v reflect.Value) (*dynamodb.AttributeValue, error)
+
+// decoder sets the addressable v to the attribute value, which isn't NULL
+type decoder func(av *dynamodb.AttributeValue, v reflect.Value) error
+
+var (
+	// codecs caches the codec of the struct types
+	codecs sync.Map // reflect.Type → *codec
+
+	marshalerType   = reflect.TypeOf((*dynamodbattribute.Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*dynamodbattribute.Unmarshaler)(nil)).Elem()
+	bytesType       = reflect.TypeOf([]byte(nil))
+	null            = &dynamodb.AttributeValue{NULL: aws.Bool(true)}
+)
+
+// codecOf returns the codec of the struct type, planned on first use
+func codecOf(typ reflect.Type) *codec {
+	if c, ok := codecs.Load(typ); ok {
+		return c.(*codec)
+	}
+	c := &codec{typ: typ}
+	for _, f := range fields(typ, nil) {
+		sf := typ.FieldByIndex(f.index)
+		if sf.PkgPath != "" {
+			continue // an unexported embedded type
+		}
+		opts := strings.Split(sf.Tag.Get("dynamodbav"), ",")[1:]
+		fc := fieldCodec{index: f.index, name: f.name, path: typ.Name() + "." + sf.Name}
+		for _, opt := range opts {
+			fc.omitEmpty = fc.omitEmpty || opt == "omitempty"
+		}
+		fc.encode, fc.decode = codingOf(sf.Type, opts)
+		c.fields = append(c.fields, fc)
+	}
+	// a concurrent first use may have stored the same plan
+	actual, _ := codecs.LoadOrStore(typ, c)
+	return actual.(*codec)
+}
+
+// codingOf plans the encoding of a type, the options are those of the
+// dynamodbav tag. The types with a custom encoding and the sets are left to
+// dynamodbattribute.
+func codingOf(typ reflect.Type, opts []string) (encoder, decoder) {
+	for _, opt := range opts {
+		if opt == "stringset" || opt == "numberset" || opt == "binaryset" {
+			return fallback(typ)
+		}
+	}
+	if typ.Implements(marshalerType) || reflect.PtrTo(typ).Implements(unmarshalerType) {
+		return fallback(typ)
+	}
+	if typ == timeType {
+		for _, opt := range opts {
+			if opt == "unixtime" {
+				return encodeUnixTime, decodeUnixTime
+			}
+		}
+		return encodeTime, decodeTime
+	}
+
+	switch typ.Kind() {
+	case reflect.Ptr:
+		encode, decode := codingOf(typ.Elem(), opts)
+		return func(v reflect.Value) (*dynamodb.AttributeValue, error) {
+				if v.IsNil() {
+					return null, nil
+				}
+				return encode(v.Elem())
+			}, func(av *dynamodb.AttributeValue, v reflect.Value) error {
+				elem := reflect.New(typ.Elem())
+				if err := decode(av, elem.Elem()); err != nil {
+					return err
+				}
+				v.Set(elem)
+				return nil
+			}
+	case reflect.String:
+		return encodeString, decodeString
+	case reflect.Bool:
+		return encodeBool, decodeBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodeInt, decodeInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return encodeUint, decodeUint
+	case reflect.Float32, reflect.Float64:
+		return encodeFloat, decodeFloat
+	case reflect.Struct:
+		return encodeStruct, decodeStruct
+	case reflect.Slice:
+		if typ == bytesType {
+			return encodeBytes, decodeBytes
+		}
+		return codingOfList(typ)
+	case reflect.Map:
+		if typ.Key().Kind() == reflect.String {
+			return codingOfMap(typ)
+		}
+	}
+	return fallback(typ)
+}
+
+// codingOfList plans the encoding of a slice as a list
+func codingOfList(typ reflect.Type) (encoder, decoder) {
+	encode, decode := codingOf(typ.Elem(), nil)
+	return func(v reflect.Value) (*dynamodb.AttributeValue, error) {
+			if v.Len() == 0 {
+				return null, nil
+			}
+			list := make([]*dynamodb.AttributeValue, v.Len())
+			for i := range list {
+				av, err := encode(v.Index(i))
+				if err != nil {
+					return nil, fmt.Errorf("[%d]: %w", i, err)
+				}
+				list[i] = av
+			}
+			return &dynamodb.AttributeValue{L: list}, nil
+		}, func(av *dynamodb.AttributeValue, v reflect.Value) error {
+			if av.L == nil {
+				return mismatch("L", av)
+			}
+			slice := reflect.MakeSlice(typ, len(av.L), len(av.L))
+			for i, elem := range av.L {
+				if err := decodeValue(decode, elem, slice.Index(i)); err != nil {
+					return fmt.Errorf("[%d]: %w", i, err)
+				}
+			}
+			v.Set(slice)
+			return nil
+		}
+}
+
+// codingOfMap plans the encoding of a map with string keys
+func codingOfMap(typ reflect.Type) (encoder, decoder) {
+	encode, decode := codingOf(typ.Elem(), nil)
+	return func(v reflect.Value) (*dynamodb.AttributeValue, error) {
+			if v.Len() == 0 {
+				return null, nil
+			}
+			m := make(map[string]*dynamodb.AttributeValue, v.Len())
+			iter := v.MapRange()
+			for iter.Next() {
+				av, err := encode(iter.Value())
+				if err != nil {
+					return nil, fmt.Errorf("[%s]: %w", iter.Key().String(), err)
+				}
+				m[iter.Key().String()] = av
+			}
+			return &dynamodb.AttributeValue{M: m}, nil
+		}, func(av *dynamodb.AttributeValue, v reflect.Value) error {
+			if av.M == nil {
+				return mismatch("M", av)
+			}
+			m := reflect.MakeMapWithSize(typ, len(av.M))
+			for key, elem := range av.M {
+				value := reflect.New(typ.Elem()).Elem()
+				if err := decodeValue(decode, elem, value); err != nil {
+					return fmt.Errorf("[%s]: %w", key, err)
+				}
+				m.SetMapIndex(reflect.ValueOf(key).Convert(typ.Key()), value)
+			}
+			v.Set(m)
+			return nil
+		}
+}
+
+// fallback leaves the encoding of the type to dynamodbattribute
+func fallback(typ reflect.Type) (encoder, decoder) {
+	return func(v reflect.Value) (*dynamodb.AttributeValue, error) {
+			return dynamodbattribute.Marshal(v.Interface())
+		}, func(av *dynamodb.AttributeValue, v reflect.Value) error {
+			return dynamodbattribute.Unmarshal(av, v.Addr().Interface())
+		}
+}
+
+// decodeValue decodes the attribute value, a NULL sets the zero value
+func decodeValue(decode decoder, av *dynamodb.AttributeValue, v reflect.Value) error {
+	if av == nil || (av.NULL != nil && *av.NULL) {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	return decode(av, v)
+}
+
+// mismatch is the error of an attribute value of an unexpected type
+func mismatch(want string, av *dynamodb.AttributeValue) error {
+	got := "an unknown type"
+	switch {
+	case av.S != nil:
+		got = "S"
+	case av.N != nil:
+		got = "N"
+	case av.BOOL != nil:
+		got = "BOOL"
+	case av.B != nil:
+		got = "B"
+	case av.L != nil:
+		got = "L"
+	case av.M != nil:
+		got = "M"
+	case av.SS != nil, av.NS != nil, av.BS != nil:
+		got = "a set"
+	}
+	return fmt.Errorf("expected %s, got %s", want, got)
+}
+
+func encodeString(v reflect.Value) (*dynamodb.AttributeValue, error) {
+	if v.Len() == 0 {
+		return null, nil
+	}
+	return &dynamodb.AttributeValue{S: aws.String(v.String())}, nil
+}
+
+func decodeString(av *dynamodb.AttributeValue, v reflect.Value) error {
+	if av.S == nil {
+		return mismatch("S", av)
+	}
+	v.SetString(*av.S)
+	return nil
+}
+
+func encodeBool(v reflect.Value) (*dynamodb.AttributeValue, error) {
+	return &dynamodb.AttributeValue{BOOL: aws.Bool(v.Bool())}, nil
+}
+
+func decodeBool(av *dynamodb.AttributeValue, v reflect.Value) error {
+	if av.BOOL == nil {
+		return mismatch("BOOL", av)
+	}
+	v.SetBool(*av.BOOL)
+	return nil
+}
+
+func encodeInt(v reflect.Value) (*dynamodb.AttributeValue, error) {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(v.Int(), 10))}, nil
+}
+
+func decodeInt(av *dynamodb.AttributeValue, v reflect.Value) error {
+	if av.N == nil {
+		return mismatch("N", av)
+	}
+	n, err := strconv.ParseInt(*av.N, 10, v.Type().Bits())
+	if err != nil {
+		return err
+	}
+	v.SetInt(n)
+	return nil
+}
+
+func encodeUint(v reflect.Value) (*dynamodb.AttributeValue, error) {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatUint(v.Uint(), 10))}, nil
+}
+
+func decodeUint(av *dynamodb.AttributeValue, v reflect.Value) error {
+	if av.N == nil {
+		return mismatch("N", av)
+	}
+	n, err := strconv.ParseUint(*av.N, 10, v.Type().Bits())
+	if err != nil {
+		return err
+	}
+	v.SetUint(n)
+	return nil
+}
+
+func encodeFloat(v reflect.Value) (*dynamodb.AttributeValue, error) {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits()))}, nil
+}
+
+func decodeFloat(av *dynamodb.AttributeValue, v reflect.Value) error {
+	if av.N == nil {
+		return mismatch("N", av)
+	}
+	n, err := strconv.ParseFloat(*av.N, v.Type().Bits())
+	if err != nil {
+		return err
+	}
+	v.SetFloat(n)
+	return nil
+}
+
+func encodeBytes(v reflect.Value) (*dynamodb.AttributeValue, error) {
+	if v.Len() == 0 {
+		return null, nil
+	}
+	return &dynamodb.AttributeValue{B: append([]byte{}, v.Bytes()...)}, nil
+}
+
+func decodeBytes(av *dynamodb.AttributeValue, v reflect.Value) error {
+	if av.B == nil {
+		return mismatch("B", av)
+	}
+	v.SetBytes(append([]byte{}, av.B...))
+	return nil
+}
+
+// timeLayout stores the times in UTC with every digit of the nanoseconds, so
+// that they sort and compare as strings in the sort indexes and the filters
+const timeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// formatTime returns the stored string of a time
+func formatTime(d time.Time) string {
+	return d.UTC().Format(timeLayout)
+}
+
+func encodeTime(v reflect.Value) (*dynamodb.AttributeValue, error) {
+	return &dynamodb.AttributeValue{S: aws.String(formatTime(v.Interface().(time.Time)))}, nil
+}
+
+func decodeTime(av *dynamodb.AttributeValue, v reflect.Value) error {
+	if av.N != nil {
+		return decodeUnixTime(av, v)
+	}
+	if av.S == nil {
+		return mismatch("S", av)
+	}
+	// the items saved before timeLayout have the offset of the local zone
+	d, err := time.Parse(time.RFC3339, *av.S)
+	if err != nil {
+		return err
+	}
+	if !d.IsZero() {
+		d = d.Local()
+	}
+	v.Set(reflect.ValueOf(d))
+	return nil
+}
+
+func encodeUnixTime(v reflect.Value) (*dynamodb.AttributeValue, error) {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(v.Interface().(time.Time).Unix(), 10))}, nil
+}
+
+func decodeUnixTime(av *dynamodb.AttributeValue, v reflect.Value) error {
+	if av.N == nil {
+		return mismatch("N", av)
+	}
+	sec, err := strconv.ParseInt(*av.N, 10, 64)
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(time.Unix(sec, 0)))
+	return nil
+}
+
+func encodeStruct(v reflect.Value) (*dynamodb.AttributeValue, error) {
+	m, err := codecOf(v.Type()).marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.AttributeValue{M: m}, nil
+}
+
+func decodeStruct(av *dynamodb.AttributeValue, v reflect.Value) error {
+	if av.M == nil {
+		return mismatch("M", av)
+	}
+	return codecOf(v.Type()).unmarshal(av.M, v)
+}
+
+// field returns the plan of the field stored in the attribute
+func (c *codec) field(attr string) (fieldCodec, bool) {
+	for _, f := range c.fields {
+		if f.name == attr {
+			return f, true
+		}
+	}
+	return fieldCodec{}, false
+}
+
+// marshal returns the attributes of the struct v
+func (c *codec) marshal(v reflect.Value) (map[string]*dynamodb.AttributeValue, error) {
+	item := make(map[string]*dynamodb.AttributeValue, len(c.fields))
+	for _, f := range c.fields {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		av, err := f.encode(fv)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.path, err)
+		}
+		if f.omitEmpty && av.NULL != nil {
+			continue
+		}
+		item[f.name] = av
+	}
+	return item, nil
+}
+
+// unmarshal sets the fields of the addressable struct v to the attributes,
+// the missing attributes leave their field unchanged
+func (c *codec) unmarshal(item map[string]*dynamodb.AttributeValue, v reflect.Value) error {
+	for _, f := range c.fields {
+		av, ok := item[f.name]
+		if !ok {
+			continue
+		}
+		if err := decodeValue(f.decode, av, v.FieldByIndex(f.index)); err != nil {
+			return fmt.Errorf("%s: %w", f.path, err)
+		}
+	}
+	return nil
+}
+
+// unmarshalList appends the items to the slice result points to, of structs
+// of the codec or pointers to them
+func (c *codec) unmarshalList(items []map[string]*dynamodb.AttributeValue, result interface{}) error {
+	slice := reflect.ValueOf(result)
+	if slice.Kind() != reflect.Ptr || slice.IsNil() || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("expected a pointer to a slice of %s, got %T", c.typ.Name(), result)
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+	pointers := elemType.Kind() == reflect.Ptr
+	if (pointers && elemType.Elem() != c.typ) || (!pointers && elemType != c.typ) {
+		return fmt.Errorf("expected a pointer to a slice of %s, got %T", c.typ.Name(), result)
+	}
+
+	list := reflect.MakeSlice(slice.Type(), len(items), len(items))
+	for i, item := range items {
+		elem := list.Index(i)
+		if pointers {
+			elem.Set(reflect.New(c.typ))
+			elem = elem.Elem()
+		}
+		if err := c.unmarshal(item, elem); err != nil {
+			return err
+		}
+	}
+	slice.Set(list)
+	return nil
+}
@@ -0,0 +1,313 @@
+package dynamo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+type codecAddress struct {
+	Street string
+	Zip    *int
+}
+
+type codecRecord struct {
+	ID        string `dynamo:"hash"`
+	Name      string `dynamodbav:"name"`
+	Count     int
+	Small     int8
+	Ratio     float64
+	Active    bool
+	Nickname  *string
+	Address   *codecAddress
+	Addresses []codecAddress
+	Tags      []string
+	Labels    map[string]string
+	Data      []byte
+	Seen      time.Time `dynamodbav:",unixtime"`
+	CreatedAt time.Time
+	Note      string `dynamodbav:",omitempty"`
+	Ignored   string `dynamodbav:"-"`
+}
+
+func fullRecord(i int) codecRecord {
+	zip := 75000 + i
+	nickname := fmt.Sprintf("nick %d", i)
+	return codecRecord{
+		ID:        fmt.Sprintf("id-%d", i),
+		Name:      fmt.Sprintf("Customer %d", i),
+		Count:     i,
+		Small:     -8,
+		Ratio:     0.25,
+		Active:    true,
+		Nickname:  &nickname,
+		Address:   &codecAddress{Street: "1 main street", Zip: &zip},
+		Addresses: []codecAddress{{Street: "2 side street"}, {Street: "3 back street", Zip: &zip}},
+		Tags:      []string{"a", "b"},
+		Labels:    map[string]string{"tier": "gold"},
+		Data:      []byte{1, 2, 3},
+		Seen:      time.Unix(1700000000+int64(i), 0),
+		CreatedAt: time.Date(2024, 3, 1, 12, 30, 0, 500, time.Local),
+		Note:      "note",
+	}
+}
+
+var recordType = reflect.TypeOf(codecRecord{})
+
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		record codecRecord
+	}{
+		{"full", fullRecord(1)},
+		// a zero unixtime reads back in the local time zone
+		{"zero", codecRecord{ID: "id", Seen: time.Unix(0, 0)}},
+		{"nil pointer in a struct", codecRecord{ID: "id", Seen: time.Unix(0, 0), Address: &codecAddress{Street: "street"}}},
+		{"slice of structs", codecRecord{ID: "id", Seen: time.Unix(0, 0), Addresses: []codecAddress{{Street: "a"}, {}}}},
+	}
+	c := codecOf(recordType)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item, err := c.marshal(reflect.ValueOf(tt.record))
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var got codecRecord
+			if err := c.unmarshal(item, reflect.ValueOf(&got).Elem()); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.record) {
+				t.Errorf("got %+v, want %+v", got, tt.record)
+			}
+		})
+	}
+}
+
+func TestCodecMarshal(t *testing.T) {
+	item, err := codecOf(recordType).marshal(reflect.ValueOf(codecRecord{
+		ID:        "id",
+		Count:     3,
+		Seen:      time.Unix(1700000000, 0),
+		CreatedAt: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Addresses: []codecAddress{{Street: "street"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		attr string
+		want *dynamodb.AttributeValue
+	}{
+		{"ID", &dynamodb.AttributeValue{S: aws.String("id")}},
+		{"name", null},
+		{"Count", &dynamodb.AttributeValue{N: aws.String("3")}},
+		{"Active", &dynamodb.AttributeValue{BOOL: aws.Bool(false)}},
+		{"Nickname", null},
+		{"Address", null},
+		{"Addresses", &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{{M: map[string]*dynamodb.AttributeValue{
+			"Street": {S: aws.String("street")},
+			"Zip":    null,
+		}}}}},
+		{"Tags", null},
+		{"Labels", null},
+		{"Data", null},
+		{"Seen", &dynamodb.AttributeValue{N: aws.String("1700000000")}},
+		{"CreatedAt", &dynamodb.AttributeValue{S: aws.String("2024-03-01T12:30:00.000000000Z")}},
+	}
+	for _, tt := range tests {
+		if got := item[tt.attr]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.attr, got, tt.want)
+		}
+	}
+	for _, attr := range []string{"Note", "Ignored", "Name"} {
+		if _, ok := item[attr]; ok {
+			t.Errorf("%s: unexpected attribute", attr)
+		}
+	}
+}
+
+func TestCodecUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		item map[string]*dynamodb.AttributeValue
+		want string
+	}{
+		{"type mismatch", map[string]*dynamodb.AttributeValue{"Count": {S: aws.String("3")}}, "codecRecord.Count: expected N, got S"},
+		{"overflow", map[string]*dynamodb.AttributeValue{"Small": {N: aws.String("300")}}, "codecRecord.Small: "},
+		{"unixtime as a string", map[string]*dynamodb.AttributeValue{"Seen": {S: aws.String("2024-03-01T12:30:00Z")}}, "codecRecord.Seen: expected N, got S"},
+		{"invalid time", map[string]*dynamodb.AttributeValue{"CreatedAt": {S: aws.String("yesterday")}}, "codecRecord.CreatedAt: "},
+		{"pointer", map[string]*dynamodb.AttributeValue{"Nickname": {BOOL: aws.Bool(true)}}, "codecRecord.Nickname: expected S, got BOOL"},
+		{"slice of structs", map[string]*dynamodb.AttributeValue{"Addresses": {L: []*dynamodb.AttributeValue{
+			{M: map[string]*dynamodb.AttributeValue{"Street": {N: aws.String("1")}}},
+		}}}, "codecRecord.Addresses: [0]: codecAddress.Street: expected S, got N"},
+		{"map", map[string]*dynamodb.AttributeValue{"Labels": {M: map[string]*dynamodb.AttributeValue{"tier": {L: []*dynamodb.AttributeValue{}}}}}, "codecRecord.Labels: [tier]: expected S, got L"},
+	}
+	c := codecOf(recordType)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got codecRecord
+			err := c.unmarshal(tt.item, reflect.ValueOf(&got).Elem())
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	paris := time.FixedZone("Paris", 2*3600)
+	// in order, the string comparison must agree
+	times := []time.Time{
+		time.Date(2024, 3, 1, 12, 0, 0, 0, paris),
+		time.Date(2024, 3, 1, 11, 0, 0, 5, time.UTC),
+		time.Date(2024, 3, 1, 11, 0, 0, 500, time.UTC),
+		time.Date(2024, 3, 1, 11, 0, 1, 0, time.UTC),
+		time.Date(2024, 3, 1, 13, 0, 2, 0, paris),
+	}
+	for i := 1; i < len(times); i++ {
+		if a, b := formatTime(times[i-1]), formatTime(times[i]); a >= b {
+			t.Errorf("%s sorts after %s", a, b)
+		}
+	}
+	if got := formatTime(times[0]); got != "2024-03-01T10:00:00.000000000Z" {
+		t.Errorf("got %s", got)
+	}
+
+	// the times saved before with an offset are still read
+	var got codecRecord
+	item := map[string]*dynamodb.AttributeValue{"CreatedAt": {S: aws.String("2024-03-01T12:00:00.5+02:00")}}
+	if err := codecOf(recordType).unmarshal(item, reflect.ValueOf(&got).Elem()); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 3, 1, 10, 0, 0, 5e8, time.UTC); !got.CreatedAt.Equal(want) || got.CreatedAt.Location() != time.Local {
+		t.Errorf("got %v, want %v in the local zone", got.CreatedAt, want)
+	}
+}
+
+func TestCodecUnmarshalList(t *testing.T) {
+	c := codecOf(recordType)
+	var items []map[string]*dynamodb.AttributeValue
+	for i := 0; i < 3; i++ {
+		item, err := c.marshal(reflect.ValueOf(fullRecord(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+
+	var values []codecRecord
+	if err := c.unmarshalList(items, &values); err != nil {
+		t.Fatal(err)
+	}
+	var pointers []*codecRecord
+	if err := c.unmarshalList(items, &pointers); err != nil {
+		t.Fatal(err)
+	}
+	for i := range items {
+		want := fullRecord(i)
+		if !reflect.DeepEqual(values[i], want) || !reflect.DeepEqual(*pointers[i], want) {
+			t.Errorf("%d: got %+v and %+v, want %+v", i, values[i], *pointers[i], want)
+		}
+	}
+
+	var wrong []codecAddress
+	if err := c.unmarshalList(items, &wrong); err == nil {
+		t.Error("expected an error for a slice of another type")
+	}
+}
+
+// scanItems returns the items of a large scan
+func scanItems(b *testing.B) []map[string]*dynamodb.AttributeValue {
+	c := codecOf(recordType)
+	items := make([]map[string]*dynamodb.AttributeValue, 1000)
+	for i := range items {
+		item, err := c.marshal(reflect.ValueOf(fullRecord(i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		items[i] = item
+	}
+	return items
+}
+
+func BenchmarkScanCodec(b *testing.B) {
+	items := scanItems(b)
+	c := codecOf(recordType)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var records []*codecRecord
+		if err := c.unmarshalList(items, &records); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScanDynamodbattribute(b *testing.B) {
+	items := scanItems(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var records []*codecRecord
+		if err := dynamodbattribute.UnmarshalListOfMaps(items, &records); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkScanDeepCopy reads the items like the handlers did before the
+// codec: dynamodbattribute then a JSON copy into the result
+func BenchmarkScanDeepCopy(b *testing.B) {
+	items := scanItems(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		records := make([]codecRecord, 0, len(items))
+		for _, item := range items {
+			var record codecRecord
+			if err := dynamodbattribute.UnmarshalMap(item, &record); err != nil {
+				b.Fatal(err)
+			}
+			records = append(records, record)
+		}
+		var result []*codecRecord
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(records); err != nil {
+			b.Fatal(err)
+		}
+		if err := json.NewDecoder(&buf).Decode(&result); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalCodec(b *testing.B) {
+	record := reflect.ValueOf(fullRecord(1))
+	c := codecOf(recordType)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.marshal(record); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalDynamodbattribute(b *testing.B) {
+	record := fullRecord(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dynamodbattribute.MarshalMap(&record); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Package dynamo stores qor resources in DynamoDB. The table of a model is
+// derived from its struct tags, see NewTable, and Configure installs the qor
+// handlers reading and writing it.
+package dynamo
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.25.0"
+
+	"qor-admin-3/admin/logging"
+	"qor-admin-3/admin/tracing"
+)
+
+// Config holds the connection settings of DynamoDB.
+// Endpoint is optional and only needed for DynamoDB Local.
+type Config struct {
+	Region   string // ex. "us-west-2"
+	Endpoint string // ex. "http://localhost:8000"
+
+	// AccessKeyID and SecretAccessKey are static credentials, ex. for
+	// DynamoDB Local. Without them the credentials come from the default
+	// chain: the environment, the shared files with Profile, then the role of
+	// the instance or the task.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Profile         string
+
+	// TablePrefix is prepended to the name of every table, to keep the
+	// environments apart in one account, ex. "staging-"
+	TablePrefix string
+
+	Timeout        time.Duration // of a whole call, including the retries, none when zero
+	ConnectTimeout time.Duration // of the connection, none when zero
+	MaxRetries     int           // of the throttled and failed calls, the SDK default when zero
+
+	// Observe is optional and called after every DynamoDB call with the qor
+	// handler making it, ex. "FindMany", and the capacity units consumed
+	Observe func(handler, operation string, d time.Duration, capacity float64, err error)
+}
+
+// DB is a DynamoDB client tracing, logging and observing its calls
+type DB struct {
+	svc     *dynamodb.DynamoDB
+	prefix  string
+	observe func(handler, operation string, d time.Duration, capacity float64, err error)
+	timeout time.Duration
+	cursors cursors
+	indexes indexes
+}
+
+// New creates the DynamoDB client, it doesn't connect
+func New(cfg Config) (*DB, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = cfg.ConnectTimeout
+	}
+	// the client timeout bounds each attempt, call bounds the whole call
+	config := aws.Config{
+		Region:     aws.String(cfg.Region),
+		HTTPClient: &http.Client{Transport: transport, Timeout: cfg.Timeout},
+	}
+	if cfg.Endpoint != "" {
+		config.Endpoint = aws.String(cfg.Endpoint)
+	}
+	if cfg.AccessKeyID != "" {
+		config.Credentials = credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken)
+	}
+	if cfg.MaxRetries > 0 {
+		config.MaxRetries = aws.Int(cfg.MaxRetries)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		Profile:           cfg.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamo: %w", err)
+	}
+	return &DB{svc: dynamodb.New(sess), prefix: cfg.TablePrefix, observe: cfg.Observe, timeout: cfg.Timeout}, nil
+}
+
+// name returns the name of the table in DynamoDB, with the prefix
+func (db *DB) name(t *Table) string {
+	return db.prefix + t.Name
+}
+
+// call traces, logs and observes a DynamoDB call, bounded by the timeout
+// with its retries. The call reports the capacity consumed, which is nil on
+// error.
+func (db *DB) call(ctx context.Context, table, handler, operation string, fn func(ctx context.Context) (*dynamodb.ConsumedCapacity, error)) error {
+	if db.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, db.timeout)
+		defer cancel()
+	}
+	ctx, span := tracing.Start(ctx, "DynamoDB."+operation,
+		semconv.DBSystemDynamoDB,
+		semconv.DBOperation(operation),
+		semconv.AWSDynamoDBTableNames(table),
+		attribute.String("qor.handler", handler),
+	)
+	start := time.Now()
+	cc, err := fn(ctx)
+	d := time.Since(start)
+
+	var units float64
+	if cc != nil && cc.CapacityUnits != nil {
+		units = *cc.CapacityUnits
+	}
+	span.SetAttributes(attribute.Float64("aws.dynamodb.consumed_capacity", units))
+	tracing.End(span, err)
+	logging.FromContext(ctx).WithFields(logrus.Fields{
+		"dynamodb_operation": operation,
+		"dynamodb_table":     table,
+		"duration":           d.String(),
+		"capacity":           units,
+	}).Debug("DynamoDB call")
+	if db.observe != nil {
+		db.observe(handler, operation, d, units, err)
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package dynamo
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/qor/validations"
+)
+
+// updatedByAttribute holds the display name of the user who saved the item
+// last, for the conflict errors
+const updatedByAttribute = "_updatedBy"
+
+// ConflictError is returned by a save when the item was changed or deleted
+// since it was loaded. Saving the same record again overwrites the changes.
+type ConflictError struct {
+	By      string // display name of the user who changed it, if known
+	Deleted bool
+}
+
+func (e *ConflictError) Error() string {
+	if e.Deleted {
+		return "This record was deleted since you loaded it"
+	}
+	by := "another user"
+	if e.By != "" {
+		by = e.By
+	}
+	return "This record was changed by " + by + " since you loaded it, reload it or save again to overwrite"
+}
+
+// RetryableError is a DynamoDB error which may succeed if the request is
+// repeated, ex. throttling. The SDK already retried it.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return "DynamoDB is busy, please try again in a moment"
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports the error may go away, like net.Error
+func (e *RetryableError) Temporary() bool {
+	return true
+}
+
+// retryable are the codes of the errors which may go away
+var retryable = map[string]bool{
+	dynamodb.ErrCodeProvisionedThroughputExceededException: true,
+	dynamodb.ErrCodeRequestLimitExceeded:                   true,
+	dynamodb.ErrCodeTransactionConflictException:           true,
+	dynamodb.ErrCodeInternalServerError:                    true,
+	"ThrottlingException":                                  true,
+	"ServiceUnavailable":                                   true,
+}
+
+// qorError maps a DynamoDB error to the error qor shows: the throttling
+// becomes a RetryableError. The rejected requests are left as is, so they
+// are logged, see formError for the saves.
+func qorError(table string, err error) error {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return err
+	}
+	switch code := aerr.Code(); {
+	case retryable[code]:
+		return &RetryableError{Err: err}
+	case code == dynamodb.ErrCodeResourceNotFoundException:
+		return fmt.Errorf("the %s table doesn't exist, run the migrate command: %w", table, err)
+	}
+	return err
+}
+
+// formError maps the error of a save like qorError, except the item rejected
+// by DynamoDB, ex. a value too large, becomes an error of the form of result
+func formError(table string, err error, result interface{}) error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == "ValidationException" {
+		return validations.NewError(result, "", aerr.Message())
+	}
+	return qorError(table, err)
+}
+
+// conditionFailed reports if the condition of a write failed
+func conditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,260 @@
+package dynamo
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+)
+
+// cursorTTL bounds how long the cursors and counts of a listing are reused.
+// The cache is flushed on every write of this process, the TTL covers the
+// writes of the other ones.
+const cursorTTL = 5 * time.Minute
+
+// maxListings is the number of listings, ex. the same table with different
+// filters, whose cursors are cached per table
+const maxListings = 64
+
+// page is the slice of the listing to read, a zero limit reads everything
+type page struct {
+	offset, limit int
+}
+
+// pageOf returns the page requested with qor's page and per_page parameters
+func pageOf(res *admin.Resource, ctx *qor.Context) page {
+	if ctx.Request == nil {
+		return page{}
+	}
+	query := ctx.Request.URL.Query()
+	current, err := strconv.Atoi(query.Get("page"))
+	if err != nil || current < 1 {
+		current = 1
+	}
+	perPage, err := strconv.Atoi(query.Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = admin.PaginationPageCount
+		if res.Config != nil && res.Config.PageCount > 0 {
+			perPage = res.Config.PageCount
+		}
+	}
+	return page{offset: (current - 1) * perPage, limit: perPage}
+}
+
+// readOutput is the result of one Scan or Query call
+type readOutput struct {
+	items []map[string]*dynamodb.AttributeValue
+	count int
+	last  map[string]*dynamodb.AttributeValue // nil after the last call
+}
+
+// reader makes one Scan or Query call of a listing from the start key. It
+// evaluates at most limit items when it isn't zero, and only counts them
+// when count is set.
+type reader func(ctx context.Context, start map[string]*dynamodb.AttributeValue, limit int, count bool) (readOutput, error)
+
+// scan reads the table with a Scan, in is the input of every call
+func (db *DB) scan(t *Table, in dynamodb.ScanInput) reader {
+	return func(ctx context.Context, start map[string]*dynamodb.AttributeValue, limit int, count bool) (readOutput, error) {
+		input := in
+		input.TableName = aws.String(db.name(t))
+		input.ExclusiveStartKey = start
+		input.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+		handler := "FindMany"
+		if count {
+			input.Select = aws.String(dynamodb.SelectCount)
+			handler = "Count"
+		}
+		if limit > 0 {
+			input.Limit = aws.Int64(int64(limit))
+		}
+		var out *dynamodb.ScanOutput
+		err := db.call(ctx, db.name(t), handler, "Scan", func(ctx context.Context) (cc *dynamodb.ConsumedCapacity, err error) {
+			if out, err = db.svc.ScanWithContext(ctx, &input); err != nil {
+				return nil, err
+			}
+			return out.ConsumedCapacity, nil
+		})
+		if err != nil {
+			return readOutput{}, err
+		}
+		return readOutput{items: out.Items, count: int(aws.Int64Value(out.Count)), last: out.LastEvaluatedKey}, nil
+	}
+}
+
+// query reads an index of the table with a Query, in is the input of every
+// call
+func (db *DB) query(t *Table, in dynamodb.QueryInput) reader {
+	return func(ctx context.Context, start map[string]*dynamodb.AttributeValue, limit int, count bool) (readOutput, error) {
+		input := in
+		input.TableName = aws.String(db.name(t))
+		input.ExclusiveStartKey = start
+		input.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+		handler := "FindMany"
+		if count {
+			input.Select = aws.String(dynamodb.SelectCount)
+			handler = "Count"
+		}
+		if limit > 0 {
+			input.Limit = aws.Int64(int64(limit))
+		}
+		var out *dynamodb.QueryOutput
+		err := db.call(ctx, db.name(t), handler, "Query", func(ctx context.Context) (cc *dynamodb.ConsumedCapacity, err error) {
+			if out, err = db.svc.QueryWithContext(ctx, &input); err != nil {
+				return nil, err
+			}
+			return out.ConsumedCapacity, nil
+		})
+		if err != nil {
+			return readOutput{}, err
+		}
+		return readOutput{items: out.Items, count: int(aws.Int64Value(out.Count)), last: out.LastEvaluatedKey}, nil
+	}
+}
+
+// read returns the items of the page. The listing is skipped up to the
+// offset with counting calls, starting from the closest cached cursor.
+func (db *DB) read(ctx context.Context, t *Table, listing string, read reader, p page) ([]map[string]*dynamodb.AttributeValue, error) {
+	at, start := 0, map[string]*dynamodb.AttributeValue(nil)
+	if p.offset > 0 {
+		at, start = db.cursors.nearest(t.Name, listing, p.offset)
+	}
+	for at < p.offset {
+		out, err := read(ctx, start, p.offset-at, true)
+		if err != nil {
+			return nil, err
+		}
+		if at, start = at+out.count, out.last; start == nil {
+			return nil, nil // past the last page
+		}
+		db.cursors.put(t.Name, listing, at, start)
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	for {
+		limit := 0
+		if p.limit > 0 {
+			limit = p.limit - len(items)
+		}
+		out, err := read(ctx, start, limit, false)
+		if err != nil {
+			return nil, err
+		}
+		items, start = append(items, out.items...), out.last
+		if start == nil || (p.limit > 0 && len(items) >= p.limit) {
+			break
+		}
+	}
+	if start != nil && p.limit > 0 {
+		db.cursors.put(t.Name, listing, p.offset+len(items), start)
+	}
+	return items, nil
+}
+
+// count returns the number of items of the listing, it's cached like the
+// cursors
+func (db *DB) count(ctx context.Context, t *Table, listing string, read reader) (int, error) {
+	if total, ok := db.cursors.total(t.Name, listing); ok {
+		return total, nil
+	}
+	var total int
+	var start map[string]*dynamodb.AttributeValue
+	for {
+		out, err := read(ctx, start, 0, true)
+		if err != nil {
+			return 0, err
+		}
+		if total, start = total+out.count, out.last; start == nil {
+			break
+		}
+	}
+	db.cursors.setTotal(t.Name, listing, total)
+	return total, nil
+}
+
+// cursors caches the start keys of the listings by offset, so a page is read
+// without rescanning the previous ones
+type cursors struct {
+	mu     sync.Mutex
+	tables map[string]map[string]*listing // by table then listing
+}
+
+// listing is the cache of one listing
+type listing struct {
+	created time.Time
+	keys    map[int]map[string]*dynamodb.AttributeValue // by offset
+	total   int
+	counted bool
+}
+
+// get returns the live cache of the listing, it's created when create is set
+func (c *cursors) get(table, name string, create bool) *listing {
+	l := c.tables[table][name]
+	if l != nil && time.Since(l.created) < cursorTTL {
+		return l
+	}
+	if !create {
+		return nil
+	}
+	if c.tables == nil {
+		c.tables = map[string]map[string]*listing{}
+	}
+	listings := c.tables[table]
+	if listings == nil || len(listings) >= maxListings {
+		listings = map[string]*listing{}
+		c.tables[table] = listings
+	}
+	l = &listing{created: time.Now(), keys: map[int]map[string]*dynamodb.AttributeValue{}}
+	listings[name] = l
+	return l
+}
+
+// nearest returns the closest cursor before the offset, a nil key is the
+// start of the listing
+func (c *cursors) nearest(table, name string, offset int) (int, map[string]*dynamodb.AttributeValue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	at, key := 0, map[string]*dynamodb.AttributeValue(nil)
+	if l := c.get(table, name, false); l != nil {
+		for o, k := range l.keys {
+			if o <= offset && o > at {
+				at, key = o, k
+			}
+		}
+	}
+	return at, key
+}
+
+func (c *cursors) put(table, name string, offset int, key map[string]*dynamodb.AttributeValue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(table, name, true).keys[offset] = key
+}
+
+func (c *cursors) total(table, name string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l := c.get(table, name, false); l != nil && l.counted {
+		return l.total, true
+	}
+	return 0, false
+}
+
+func (c *cursors) setTotal(table, name string, total int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := c.get(table, name, true)
+	l.total, l.counted = total, true
+}
+
+// flush drops the cache of the table, after a write shifted its items
+func (c *cursors) flush(table string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tables, table)
+}
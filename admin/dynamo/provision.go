@@ -0,0 +1,426 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	"qor-admin-3/admin/logging"
+)
+
+// indexPollInterval is how often Provision checks if the table and its
+// indexes are active
+const indexPollInterval = 5 * time.Second
+
+// Migration is a versioned change of the items of a table, ex. backfilling
+// an attribute. It's applied once, in the order of the versions, and recorded
+// in the SchemaMigrations table. Two processes migrating at the same time may
+// both apply it, so it must be idempotent.
+//
+// The key schema, the sort indexes and the TTL don't need migrations,
+// Provision derives them from the model.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *DB, t *Table) error
+}
+
+// migration records an applied Migration
+type migration struct {
+	ID        string `dynamo:"hash"` // table#version
+	Table     string
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+// migrations is the table recording the applied migrations
+var migrations = MustTable(&migration{}, "SchemaMigrations")
+
+// Provision creates the table when it doesn't exist, or adds its missing
+// sort indexes, and enables its TTL. It waits until the table and its
+// indexes are active, then applies the pending migrations.
+func (db *DB) Provision(ctx context.Context, t *Table) error {
+	log := logging.FromContext(ctx).WithField("dynamodb_table", db.name(t))
+	desc, err := db.describe(ctx, t, "Provision")
+	var aerr awserr.Error
+	switch {
+	case errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException:
+		if err := db.createTable(ctx, t); err != nil {
+			return err
+		}
+		log.Info("Created the DynamoDB table")
+	case err != nil:
+		return err
+	default:
+		if err := db.addIndexes(ctx, t, desc); err != nil {
+			return err
+		}
+	}
+	if err := db.enableTTL(ctx, t); err != nil {
+		return err
+	}
+	return db.migrate(ctx, t)
+}
+
+// createTable creates the table and waits until it's active
+func (db *DB) createTable(ctx context.Context, t *Table) error {
+	input := &dynamodb.CreateTableInput{
+		TableName: aws.String(db.name(t)),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(t.hash.name), AttributeType: aws.String(t.hash.kind)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(t.hash.name), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		BillingMode:           aws.String(t.BillingMode),
+		ProvisionedThroughput: t.throughput(),
+	}
+	if len(t.indexes) > 0 {
+		input.AttributeDefinitions = append(input.AttributeDefinitions, &dynamodb.AttributeDefinition{
+			AttributeName: aws.String(kindAttribute), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+		})
+	}
+	for _, f := range t.indexes {
+		input.AttributeDefinitions = append(input.AttributeDefinitions, &dynamodb.AttributeDefinition{
+			AttributeName: aws.String(f.name), AttributeType: aws.String(f.kind),
+		})
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndex{
+			IndexName:             aws.String(f.indexName()),
+			KeySchema:             t.indexKey(f),
+			Projection:            &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+			ProvisionedThroughput: t.throughput(),
+		})
+	}
+	err := db.call(ctx, db.name(t), "Provision", "CreateTable", func(ctx context.Context) (*dynamodb.ConsumedCapacity, error) {
+		_, err := db.svc.CreateTableWithContext(ctx, input)
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.waitUntilActive(ctx, t)
+	return err
+}
+
+// addIndexes creates the sort indexes missing from the table, one at a time
+// as DynamoDB requires, and waits until they are active. A table or an index
+// still being created, ex. by another process, is waited for first.
+func (db *DB) addIndexes(ctx context.Context, t *Table, desc *dynamodb.TableDescription) error {
+	if !tableActive(desc) {
+		logging.FromContext(ctx).WithField("dynamodb_table", db.name(t)).Info("Waiting until the table and its indexes are active")
+		var err error
+		if desc, err = db.waitUntilActive(ctx, t); err != nil {
+			return err
+		}
+	}
+	existing := map[string]bool{}
+	for _, index := range desc.GlobalSecondaryIndexes {
+		existing[aws.StringValue(index.IndexName)] = true
+	}
+	for _, f := range t.indexes {
+		if existing[f.indexName()] {
+			continue
+		}
+		input := &dynamodb.UpdateTableInput{
+			TableName: aws.String(db.name(t)),
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String(kindAttribute), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+				{AttributeName: aws.String(f.name), AttributeType: aws.String(f.kind)},
+			},
+			GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{{
+				Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+					IndexName:             aws.String(f.indexName()),
+					KeySchema:             t.indexKey(f),
+					Projection:            &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+					ProvisionedThroughput: t.throughput(),
+				},
+			}},
+		}
+		err := db.call(ctx, db.name(t), "Provision", "UpdateTable", func(ctx context.Context) (*dynamodb.ConsumedCapacity, error) {
+			_, err := db.svc.UpdateTableWithContext(ctx, input)
+			return nil, err
+		})
+		if err != nil {
+			return fmt.Errorf("dynamo: unable to add the %s index to %s: %w", f.indexName(), db.name(t), err)
+		}
+		logging.FromContext(ctx).WithFields(logrus.Fields{
+			"dynamodb_table": db.name(t),
+			"index":          f.indexName(),
+		}).Info("Adding a sort index, waiting until it's active")
+		if _, err := db.waitUntilActive(ctx, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableActive reports if the table and all its indexes are active
+func tableActive(desc *dynamodb.TableDescription) bool {
+	if aws.StringValue(desc.TableStatus) != dynamodb.TableStatusActive {
+		return false
+	}
+	for _, index := range desc.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexStatus) != dynamodb.IndexStatusActive {
+			return false
+		}
+	}
+	return true
+}
+
+// describe returns the description of the table, handler is the qor handler
+// or the task asking for it, see Config.Observe
+func (db *DB) describe(ctx context.Context, t *Table, handler string) (*dynamodb.TableDescription, error) {
+	var out *dynamodb.DescribeTableOutput
+	err := db.call(ctx, db.name(t), handler, "DescribeTable", func(ctx context.Context) (cc *dynamodb.ConsumedCapacity, err error) {
+		out, err = db.svc.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(db.name(t))})
+		return nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Table, nil
+}
+
+// waitUntilActive polls the table until it and all its indexes are active
+// and returns its description
+func (db *DB) waitUntilActive(ctx context.Context, t *Table) (*dynamodb.TableDescription, error) {
+	for {
+		desc, err := db.describe(ctx, t, "Provision")
+		if err != nil {
+			return nil, err
+		}
+		if tableActive(desc) {
+			return desc, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(indexPollInterval):
+		}
+	}
+}
+
+// indexKey is the key schema of the sort index of the field
+func (t *Table) indexKey(f field) []*dynamodb.KeySchemaElement {
+	return []*dynamodb.KeySchemaElement{
+		{AttributeName: aws.String(kindAttribute), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		{AttributeName: aws.String(f.name), KeyType: aws.String(dynamodb.KeyTypeRange)},
+	}
+}
+
+// throughput is the capacity of the table and its indexes in PROVISIONED
+// mode, nil otherwise
+func (t *Table) throughput() *dynamodb.ProvisionedThroughput {
+	if t.BillingMode != dynamodb.BillingModeProvisioned {
+		return nil
+	}
+	return &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(t.ReadCapacity),
+		WriteCapacityUnits: aws.Int64(t.WriteCapacity),
+	}
+}
+
+// enableTTL enables the expiry of the items on the TTL field, if any
+func (db *DB) enableTTL(ctx context.Context, t *Table) error {
+	if t.ttl == nil {
+		return nil
+	}
+	var out *dynamodb.DescribeTimeToLiveOutput
+	err := db.call(ctx, db.name(t), "Provision", "DescribeTimeToLive", func(ctx context.Context) (cc *dynamodb.ConsumedCapacity, err error) {
+		out, err = db.svc.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(db.name(t))})
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+	if d := out.TimeToLiveDescription; d != nil && aws.StringValue(d.AttributeName) == t.ttl.name &&
+		aws.StringValue(d.TimeToLiveStatus) != dynamodb.TimeToLiveStatusDisabled {
+		return nil
+	}
+	return db.call(ctx, db.name(t), "Provision", "UpdateTimeToLive", func(ctx context.Context) (*dynamodb.ConsumedCapacity, error) {
+		_, err := db.svc.UpdateTimeToLiveWithContext(ctx, &dynamodb.UpdateTimeToLiveInput{
+			TableName: aws.String(db.name(t)),
+			TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+				AttributeName: aws.String(t.ttl.name),
+				Enabled:       aws.Bool(true),
+			},
+		})
+		return nil, err
+	})
+}
+
+// migrate applies the migrations of the table which aren't recorded yet
+func (db *DB) migrate(ctx context.Context, t *Table) error {
+	if len(t.Migrations) == 0 {
+		return nil
+	}
+	if err := db.Provision(ctx, migrations); err != nil {
+		return err
+	}
+
+	pending := append([]Migration{}, t.Migrations...)
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+	for _, m := range pending {
+		record := migration{ID: t.Name + "#" + strconv.Itoa(m.Version)}
+		err := db.findOne(ctx, migrations, record.ID, &record)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		log := logging.FromContext(ctx).WithFields(logrus.Fields{
+			"dynamodb_table": db.name(t),
+			"version":        m.Version,
+			"migration":      m.Name,
+		})
+		log.Info("Applying a DynamoDB migration")
+		if err := m.Up(ctx, db, t); err != nil {
+			return fmt.Errorf("dynamo: migration %d of %s (%s) failed: %w", m.Version, t.Name, m.Name, err)
+		}
+		record.Table, record.Version, record.Name, record.AppliedAt = t.Name, m.Version, m.Name, time.Now()
+		if err := db.Put(ctx, migrations, &record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillSortKey is the Up of a Migration setting the partition key of the
+// sort indexes on the items saved before the model had any. Without it, the
+// sorted listings don't show those items.
+func BackfillSortKey(ctx context.Context, db *DB, t *Table) error {
+	if len(t.indexes) == 0 {
+		return nil
+	}
+	var e expression
+	read := db.scan(t, dynamodb.ScanInput{
+		FilterExpression:         aws.String("attribute_not_exists(" + e.name(kindAttribute) + ")"),
+		ProjectionExpression:     aws.String(e.name(t.hash.name)),
+		ExpressionAttributeNames: e.names,
+	})
+	var start map[string]*dynamodb.AttributeValue
+	for {
+		out, err := read(ctx, start, 0, false)
+		if err != nil {
+			return err
+		}
+		for _, key := range out.items {
+			var e expression
+			input := &dynamodb.UpdateItemInput{
+				TableName:        aws.String(db.name(t)),
+				Key:              key,
+				UpdateExpression: aws.String("SET " + e.name(kindAttribute) + " = " + e.value(&dynamodb.AttributeValue{S: aws.String(t.typ.Name())})),
+				// an item deleted meanwhile isn't recreated
+				ConditionExpression:       aws.String("attribute_exists(" + e.name(t.hash.name) + ")"),
+				ExpressionAttributeNames:  e.names,
+				ExpressionAttributeValues: e.values,
+				ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+			}
+			err := db.call(ctx, db.name(t), "Migrate", "UpdateItem", func(ctx context.Context) (*dynamodb.ConsumedCapacity, error) {
+				out, err := db.svc.UpdateItemWithContext(ctx, input)
+				if err != nil {
+					return nil, err
+				}
+				return out.ConsumedCapacity, nil
+			})
+			if err != nil && !conditionFailed(err) {
+				return err
+			}
+		}
+		if start = out.last; start == nil {
+			break
+		}
+	}
+	db.cursors.flush(t.Name)
+	return nil
+}
+
+// NormalizeTimes is the Up of a Migration rewriting the times of the items
+// saved with the offset of the local zone in the fixed-width UTC format, so
+// that the sort indexes and the filters compare them as strings. An item
+// saved meanwhile is left alone, it's already normalized.
+func NormalizeTimes(ctx context.Context, db *DB, t *Table) error {
+	var attrs []string
+	for _, f := range t.fields {
+		typ := t.typ.FieldByIndex(f.index).Type
+		if f.kind == dynamodb.ScalarAttributeTypeS && (typ == timeType || typ == reflect.PtrTo(timeType)) {
+			attrs = append(attrs, f.name)
+		}
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	var e expression
+	projection := []string{e.name(t.hash.name)}
+	for _, attr := range attrs {
+		projection = append(projection, e.name(attr))
+	}
+	read := db.scan(t, dynamodb.ScanInput{
+		ProjectionExpression:     aws.String(strings.Join(projection, ", ")),
+		ExpressionAttributeNames: e.names,
+	})
+	var start map[string]*dynamodb.AttributeValue
+	for {
+		out, err := read(ctx, start, 0, false)
+		if err != nil {
+			return err
+		}
+		for _, item := range out.items {
+			var e expression
+			var set, unchanged []string
+			for _, attr := range attrs {
+				av := item[attr]
+				if av == nil || av.S == nil {
+					continue
+				}
+				d, err := time.Parse(time.RFC3339, *av.S)
+				if err != nil || formatTime(d) == *av.S {
+					continue
+				}
+				set = append(set, e.name(attr)+" = "+e.value(&dynamodb.AttributeValue{S: aws.String(formatTime(d))}))
+				unchanged = append(unchanged, e.name(attr)+" = "+e.value(av))
+			}
+			if len(set) == 0 {
+				continue
+			}
+			input := &dynamodb.UpdateItemInput{
+				TableName:                 aws.String(db.name(t)),
+				Key:                       map[string]*dynamodb.AttributeValue{t.hash.name: item[t.hash.name]},
+				UpdateExpression:          aws.String("SET " + strings.Join(set, ", ")),
+				ConditionExpression:       aws.String(strings.Join(unchanged, " AND ")),
+				ExpressionAttributeNames:  e.names,
+				ExpressionAttributeValues: e.values,
+				ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+			}
+			err := db.call(ctx, db.name(t), "Migrate", "UpdateItem", func(ctx context.Context) (*dynamodb.ConsumedCapacity, error) {
+				out, err := db.svc.UpdateItemWithContext(ctx, input)
+				if err != nil {
+					return nil, err
+				}
+				return out.ConsumedCapacity, nil
+			})
+			if err != nil && !conditionFailed(err) {
+				return err
+			}
+		}
+		if start = out.last; start == nil {
+			break
+		}
+	}
+	db.cursors.flush(t.Name)
+	return nil
+}
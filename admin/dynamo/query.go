@@ -0,0 +1,479 @@
+package dynamo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/qor/qor"
+	"github.com/sirupsen/logrus"
+
+	"qor-admin-3/admin/logging"
+)
+
+// filterParam matches qor's filter parameters, ex. filters[Name].Value
+var filterParam = regexp.MustCompile(`^filters\[(.+?)\]\.(Value|Operation|Start|End)$`)
+
+// dateLayouts are the layouts accepted by the date range filters, in the
+// local time zone
+var dateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// condition filters the listing on an attribute
+type condition struct {
+	field  field
+	op     string // =, <, <=, >, >=, between, begins_with, contains, present or blank
+	values []*dynamodb.AttributeValue
+}
+
+// keyCondition reports if the condition can be the key condition of a sort
+// index
+func (c condition) keyCondition() bool {
+	switch c.op {
+	case "=", "<", "<=", ">", ">=", "between", "begins_with":
+		return true
+	}
+	return false
+}
+
+// search is the keyword, filters and order of a listing
+type search struct {
+	keyword    string
+	conditions []condition
+	order      *field
+	desc       bool
+	trash      bool // lists the soft deleted items instead of the others
+
+	// signature identifies the listing in the cursor cache
+	signature string
+}
+
+// excludesBlank reports if a condition of the search leaves out the items
+// whose field is blank
+func (s search) excludesBlank(f field) bool {
+	for _, c := range s.conditions {
+		if c.field.name == f.name && c.op != "blank" {
+			return true
+		}
+	}
+	return false
+}
+
+// searchOf parses qor's keyword, filters[Name], order_by and scopes
+// parameters. The filters on unknown attributes or with invalid values are
+// ignored.
+func searchOf(t *Table, ctx *qor.Context) search {
+	var s search
+	if ctx.Request == nil {
+		return s
+	}
+	log := logging.FromContext(ctx.Request.Context())
+	query := ctx.Request.URL.Query()
+	normalized := url.Values{}
+
+	if s.keyword = strings.TrimSpace(query.Get("keyword")); s.keyword != "" {
+		normalized.Set("keyword", s.keyword)
+	}
+
+	filters := map[string]map[string]string{}
+	for param := range query {
+		if m := filterParam.FindStringSubmatch(param); m != nil && query.Get(param) != "" {
+			if filters[m[1]] == nil {
+				filters[m[1]] = map[string]string{}
+			}
+			filters[m[1]][m[2]] = query.Get(param)
+			normalized.Set(param, query.Get(param))
+		}
+	}
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, ok := t.field(name)
+		if !ok {
+			log.WithField("filter", name).Debug("Ignored the filter of an unknown attribute")
+			continue
+		}
+		c, err := t.condition(f, filters[name])
+		if err != nil {
+			log.WithError(err).WithField("filter", name).Debug("Ignored an invalid filter")
+			continue
+		}
+		if c.op != "" {
+			s.conditions = append(s.conditions, c)
+		}
+	}
+
+	if order := query.Get("order_by"); order != "" {
+		if f, ok := t.field(strings.TrimSuffix(order, "_desc")); ok {
+			s.order, s.desc = &f, strings.HasSuffix(order, "_desc")
+			normalized.Set("order_by", order)
+		}
+	}
+	for _, scope := range query["scopes"] {
+		if scope == TrashScope && t.deletedAt != nil {
+			s.trash = true
+			normalized.Set("scopes", scope)
+		}
+	}
+	s.signature = normalized.Encode()
+	return s
+}
+
+// condition returns the condition of a qor filter, its parameters are keyed
+// by Value, Operation, Start and End
+func (t *Table) condition(f field, params map[string]string) (condition, error) {
+	c := condition{field: f}
+	if params["Start"] != "" || params["End"] != "" {
+		var start, end *dynamodb.AttributeValue
+		var err error
+		if params["Start"] != "" {
+			if start, err = t.attributeValue(f, params["Start"], false); err != nil {
+				return c, err
+			}
+		}
+		if params["End"] != "" {
+			if end, err = t.attributeValue(f, params["End"], true); err != nil {
+				return c, err
+			}
+		}
+		switch {
+		case start != nil && end != nil:
+			c.op, c.values = "between", []*dynamodb.AttributeValue{start, end}
+		case start != nil:
+			c.op, c.values = ">=", []*dynamodb.AttributeValue{start}
+		default:
+			c.op, c.values = "<=", []*dynamodb.AttributeValue{end}
+		}
+		return c, nil
+	}
+
+	switch params["Operation"] {
+	case "", "eq", "equal":
+		c.op = "="
+	case "cont", "contains":
+		c.op = "contains"
+	case "start_with", "begins_with":
+		c.op = "begins_with"
+	case "gt":
+		c.op = ">"
+	case "gteq", "gte":
+		c.op = ">="
+	case "lt":
+		c.op = "<"
+	case "lteq", "lte":
+		c.op = "<="
+	case "present", "blank":
+		c.op = params["Operation"]
+		return c, nil
+	default:
+		return c, fmt.Errorf("unsupported operation %q", params["Operation"])
+	}
+	if params["Value"] == "" {
+		return condition{}, nil
+	}
+	value, err := t.attributeValue(f, params["Value"], false)
+	if err != nil {
+		return c, err
+	}
+	c.values = []*dynamodb.AttributeValue{value}
+	return c, nil
+}
+
+// attributeValue converts a filter value to the type of the attribute. The
+// times are stored as fixed-width UTC strings and compared as such, the end
+// of a date range includes the whole day.
+func (t *Table) attributeValue(f field, value string, end bool) (*dynamodb.AttributeValue, error) {
+	typ := t.typ.FieldByIndex(f.index).Type
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == timeType {
+		for _, layout := range dateLayouts {
+			d, err := time.ParseInLocation(layout, value, time.Local)
+			if err != nil {
+				continue
+			}
+			if end && layout == "2006-01-02" {
+				d = d.Add(24*time.Hour - time.Nanosecond)
+			}
+			return timeValue(f, d), nil
+		}
+		return nil, fmt.Errorf("%q is not a date", value)
+	}
+
+	switch f.kind {
+	case dynamodb.ScalarAttributeTypeS:
+		return &dynamodb.AttributeValue{S: aws.String(value)}, nil
+	case dynamodb.ScalarAttributeTypeN:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return &dynamodb.AttributeValue{N: aws.String(value)}, nil
+	case "BOOL":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", value)
+		}
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(b)}, nil
+	}
+	return nil, fmt.Errorf("the %s attribute can't be filtered", f.name)
+}
+
+// timeValue returns the attribute value of a time field, a string or, with
+// the unixtime option, a number of seconds
+func timeValue(f field, d time.Time) *dynamodb.AttributeValue {
+	if f.kind == dynamodb.ScalarAttributeTypeN {
+		return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(d.Unix(), 10))}
+	}
+	return &dynamodb.AttributeValue{S: aws.String(formatTime(d))}
+}
+
+// expression collects the placeholders of a DynamoDB expression
+type expression struct {
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+func (e *expression) name(attr string) string {
+	if e.names == nil {
+		e.names = map[string]*string{}
+	}
+	for placeholder, name := range e.names {
+		if *name == attr {
+			return placeholder
+		}
+	}
+	placeholder := "#n" + strconv.Itoa(len(e.names))
+	e.names[placeholder] = aws.String(attr)
+	return placeholder
+}
+
+func (e *expression) value(av *dynamodb.AttributeValue) string {
+	if e.values == nil {
+		e.values = map[string]*dynamodb.AttributeValue{}
+	}
+	placeholder := ":v" + strconv.Itoa(len(e.values))
+	e.values[placeholder] = av
+	return placeholder
+}
+
+// update returns the update expression setting every attribute of the item
+// and removing the null ones. The attributes are sorted so the expression is
+// stable.
+func (e *expression) update(item map[string]*dynamodb.AttributeValue) string {
+	attrs := make([]string, 0, len(item))
+	for attr := range item {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+
+	var set, remove []string
+	for _, attr := range attrs {
+		if av := item[attr]; av.NULL != nil && *av.NULL {
+			remove = append(remove, e.name(attr))
+			continue
+		}
+		set = append(set, e.name(attr)+" = "+e.value(item[attr]))
+	}
+
+	var expr []string
+	if len(set) > 0 {
+		expr = append(expr, "SET "+strings.Join(set, ", "))
+	}
+	if len(remove) > 0 {
+		expr = append(expr, "REMOVE "+strings.Join(remove, ", "))
+	}
+	return strings.Join(expr, " ")
+}
+
+// condition returns the expression of the condition. The nil pointers and
+// empty strings are stored as NULL attributes, they are blank.
+func (e *expression) condition(c condition) string {
+	name := e.name(c.field.name)
+	switch c.op {
+	case "between":
+		return name + " BETWEEN " + e.value(c.values[0]) + " AND " + e.value(c.values[1])
+	case "begins_with", "contains":
+		return c.op + "(" + name + ", " + e.value(c.values[0]) + ")"
+	case "present":
+		return "(attribute_exists(" + name + ") AND NOT attribute_type(" + name + ", " + e.value(&dynamodb.AttributeValue{S: aws.String("NULL")}) + "))"
+	case "blank":
+		return "(attribute_not_exists(" + name + ") OR attribute_type(" + name + ", " + e.value(&dynamodb.AttributeValue{S: aws.String("NULL")}) + "))"
+	}
+	return name + " " + c.op + " " + e.value(c.values[0])
+}
+
+// keyword returns the expression matching the keyword in any text attribute,
+// the match is case sensitive
+func (e *expression) keyword(t *Table, keyword string) string {
+	var or []string
+	for _, f := range t.fields {
+		if f.kind == dynamodb.ScalarAttributeTypeS && t.typ.FieldByIndex(f.index).Type != timeType {
+			or = append(or, "contains("+e.name(f.name)+", "+e.value(&dynamodb.AttributeValue{S: aws.String(keyword)})+")")
+		}
+	}
+	if len(or) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(or, " OR ") + ")"
+}
+
+// plan returns the reader of the search. It queries a sort index when the
+// listing is ordered by, or filtered on a range of, an indexed attribute.
+// An order alone can't use the index of a sparse field, it would leave out
+// the blank items. Otherwise it scans the whole table, unordered, and
+// returns why.
+func (db *DB) plan(ctx context.Context, t *Table, s search) (reader, string, error) {
+	active, err := db.indexes.active(ctx, db, t)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var index *field
+	var reason string
+	switch {
+	case s.order != nil && t.sortIndex(*s.order) && active[s.order.indexName()] && (!t.sparse(*s.order) || s.excludesBlank(*s.order)):
+		index = s.order
+	case s.order != nil && t.sortIndex(*s.order):
+		reason = "the blank values of " + s.order.name + " are missing from its sort index"
+		if !active[s.order.indexName()] {
+			reason = "the sort index on " + s.order.name + " isn't active"
+		}
+	case s.order != nil:
+		reason = "no sort index on " + s.order.name
+	default:
+		for _, c := range s.conditions {
+			if c.keyCondition() && t.sortIndex(c.field) && active[c.field.indexName()] {
+				index = &c.field
+				break
+			}
+		}
+	}
+
+	// a query filters on the sort attribute with one key condition only
+	var key *condition
+	if index != nil {
+		for i, c := range s.conditions {
+			if c.field.name != index.name {
+				continue
+			}
+			if key != nil || !c.keyCondition() {
+				index, reason = nil, "the filters on "+c.field.name+" can't use its sort index"
+				break
+			}
+			key = &s.conditions[i]
+		}
+	}
+
+	var e expression
+	var filters []string
+	if s.keyword != "" {
+		if expr := e.keyword(t, s.keyword); expr != "" {
+			filters = append(filters, expr)
+		}
+	}
+	for _, c := range s.conditions {
+		if index == nil || c.field.name != index.name {
+			filters = append(filters, e.condition(c))
+		}
+	}
+	filtered := len(filters) > 0
+	if t.deletedAt != nil {
+		deleted := condition{field: *t.deletedAt, op: "blank"}
+		if s.trash {
+			deleted.op = "present"
+		}
+		filters = append(filters, e.condition(deleted))
+	}
+	var filter *string
+	if len(filters) > 0 {
+		filter = aws.String(strings.Join(filters, " AND "))
+	}
+
+	if index == nil {
+		if reason == "" && filtered {
+			reason = "no sort index matches the search"
+		}
+		return db.scan(t, dynamodb.ScanInput{
+			FilterExpression:          filter,
+			ExpressionAttributeNames:  e.names,
+			ExpressionAttributeValues: e.values,
+		}), reason, nil
+	}
+
+	keyCondition := e.name(kindAttribute) + " = " + e.value(&dynamodb.AttributeValue{S: aws.String(t.typ.Name())})
+	if key != nil {
+		keyCondition += " AND " + e.condition(*key)
+	}
+	return db.query(t, dynamodb.QueryInput{
+		IndexName:                 aws.String(index.indexName()),
+		KeyConditionExpression:    aws.String(keyCondition),
+		FilterExpression:          filter,
+		ExpressionAttributeNames:  e.names,
+		ExpressionAttributeValues: e.values,
+		ScanIndexForward:          aws.Bool(!s.desc),
+	}), "", nil
+}
+
+// reportScan logs why a search falls back to a full table scan
+func reportScan(ctx context.Context, table, reason string) {
+	logging.FromContext(ctx).WithFields(logrus.Fields{
+		"dynamodb_table": table,
+		"reason":         reason,
+	}).Info("Search falls back to a full table scan")
+}
+
+// indexes caches the sort indexes of the tables which are active, so the
+// listings don't query an index which is still being created
+type indexes struct {
+	mu     sync.Mutex
+	tables map[string]activeIndexes
+}
+
+type activeIndexes struct {
+	checked time.Time
+	names   map[string]bool
+}
+
+// active returns the active sort indexes of the table, checked at most every
+// cursorTTL
+func (i *indexes) active(ctx context.Context, db *DB, t *Table) (map[string]bool, error) {
+	if len(t.indexes) == 0 {
+		return nil, nil
+	}
+	i.mu.Lock()
+	cached, ok := i.tables[t.Name]
+	i.mu.Unlock()
+	if ok && time.Since(cached.checked) < cursorTTL {
+		return cached.names, nil
+	}
+
+	desc, err := db.describe(ctx, t, "FindMany")
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, index := range desc.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexStatus) == dynamodb.IndexStatusActive {
+			names[aws.StringValue(index.IndexName)] = true
+		}
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.tables == nil {
+		i.tables = map[string]activeIndexes{}
+	}
+	i.tables[t.Name] = activeIndexes{checked: time.Now(), names: names}
+	return names, nil
+}
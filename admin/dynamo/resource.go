@@ -0,0 +1,335 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+	"github.com/sirupsen/logrus"
+
+	"qor-admin-3/admin/logging"
+)
+
+// Configure stores the resource in the table, its model must be the one the
+// table was derived from. The version field, if any, is a hidden field of
+// the forms and must stay in the edit attributes.
+//
+// With soft deletes, the deleted records are listed in the Trash scope,
+// with actions to restore or purge them. The batch actions delete the
+// selected records with BatchWriteItem, see BatchDelete, and trash or update
+// them with conditional updates.
+func (db *DB) Configure(res *admin.Resource, t *Table) {
+	table := db.name(t)
+	// the edit form posts back the version it loaded
+	if t.version != nil {
+		res.Meta(&admin.Meta{Name: t.version.goName, Type: "hidden"})
+	}
+	if t.deletedAt != nil {
+		db.configureTrash(res, t)
+	}
+	db.configureBatch(res, t)
+
+	res.FindOneHandler = func(result interface{}, metaValues *resource.MetaValues, ctx *qor.Context) error {
+		if !res.HasPermission(roles.Read, ctx) {
+			return roles.ErrPermissionDenied
+		}
+		err := db.findOne(ctx.Request.Context(), t, ctx.ResourceID, result)
+		return report(ctx, table, "Couldn't read the record", qorError(table, err))
+	}
+
+	res.FindManyHandler = func(result interface{}, ctx *qor.Context) error {
+		if !res.HasPermission(roles.Read, ctx) {
+			return roles.ErrPermissionDenied
+		}
+		s := searchOf(t, ctx)
+		// qor asks for the total with an *int before reading the page
+		if total, ok := result.(*int); ok {
+			n, err := db.total(ctx.Request.Context(), t, s)
+			*total = n
+			return report(ctx, table, "Couldn't count the records", qorError(table, err))
+		}
+		reason, err := db.findMany(ctx.Request.Context(), t, s, pageOf(res, ctx), result)
+		if err == nil && s.order != nil && reason != "" {
+			// a scan returns the items in no particular order
+			(&admin.Context{Context: ctx, Admin: res.GetAdmin()}).Flash(fmt.Sprintf("The list isn't sorted by %s: %s", s.order.goName, reason), "warning")
+		}
+		return report(ctx, table, "Couldn't list the records", qorError(table, err))
+	}
+
+	res.SaveHandler = func(result interface{}, ctx *qor.Context) error {
+		if !res.HasPermission(roles.Create, ctx) && !res.HasPermission(roles.Update, ctx) {
+			return roles.ErrPermissionDenied
+		}
+		// qor loads the record of an update first, so only creates have no ID
+		err := db.save(ctx.Request.Context(), t, result, ctx.ResourceID == "", userOf(ctx))
+		if err == nil {
+			logging.FromContext(ctx.Request.Context()).WithField("dynamodb_table", table).Info("Record saved")
+		}
+		return report(ctx, table, "Couldn't save the record", formError(table, err, result))
+	}
+
+	res.DeleteHandler = func(result interface{}, ctx *qor.Context) error {
+		if !res.HasPermission(roles.Delete, ctx) {
+			return roles.ErrPermissionDenied
+		}
+		msg := "Record deleted"
+		var err error
+		if t.deletedAt != nil {
+			msg = "Record moved to the trash"
+			err = db.Trash(ctx.Request.Context(), t, ctx.ResourceID, userOf(ctx))
+		} else {
+			err = db.delete(ctx.Request.Context(), t, ctx.ResourceID)
+		}
+		if err == nil {
+			logging.FromContext(ctx.Request.Context()).WithFields(logrus.Fields{
+				"dynamodb_table": table,
+				"id":             ctx.ResourceID,
+			}).Info(msg)
+		}
+		return report(ctx, table, "Couldn't delete the record", qorError(table, err))
+	}
+}
+
+// userOf returns the display name of the current user, if any
+func userOf(ctx *qor.Context) string {
+	if ctx.CurrentUser == nil {
+		return ""
+	}
+	return ctx.CurrentUser.DisplayName()
+}
+
+// report logs the unexpected errors of a handler. The missing records and the
+// errors of the forms are left to qor.
+func report(ctx *qor.Context, table, msg string, err error) error {
+	var verr validations.Error
+	var conflict *ConflictError
+	if err == nil || errors.Is(err, gorm.ErrRecordNotFound) || errors.As(err, &verr) || errors.As(err, &conflict) {
+		return err
+	}
+	log := logging.FromContext(ctx.Request.Context()).WithError(err).WithField("dynamodb_table", table)
+	if errors.As(err, new(*RetryableError)) {
+		log.Warn(msg)
+	} else {
+		log.Error(msg)
+	}
+	return err
+}
+
+// findOne reads the item into result, a pointer to a struct of the table.
+// The items in the trash are not found.
+func (db *DB) findOne(ctx context.Context, t *Table, id string, result interface{}) error {
+	key := t.key(id)
+	if key == nil {
+		return gorm.ErrRecordNotFound
+	}
+	var out *dynamodb.GetItemOutput
+	err := db.call(ctx, db.name(t), "FindOne", "GetItem", func(ctx context.Context) (cc *dynamodb.ConsumedCapacity, err error) {
+		out, err = db.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:              aws.String(db.name(t)),
+			Key:                    key,
+			ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return out.ConsumedCapacity, nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(out.Item) == 0 || t.deleted(out.Item) {
+		return gorm.ErrRecordNotFound
+	}
+	v, err := t.value(result)
+	if err != nil {
+		return err
+	}
+	if err := t.codec.unmarshal(out.Item, v); err != nil {
+		return fmt.Errorf("dynamo: unable to read the %s item %s: %w", db.name(t), id, err)
+	}
+	return nil
+}
+
+// findMany reads the page of the search into result, a pointer to a slice.
+// It returns why the table was scanned instead of queried, if it was.
+func (db *DB) findMany(ctx context.Context, t *Table, s search, p page, result interface{}) (string, error) {
+	read, reason, err := db.plan(ctx, t, s)
+	if err != nil {
+		return "", err
+	}
+	if reason != "" {
+		reportScan(ctx, db.name(t), reason)
+	}
+	items, err := db.read(ctx, t, s.signature, read, p)
+	if err != nil {
+		return reason, err
+	}
+	if err := t.codec.unmarshalList(items, result); err != nil {
+		return reason, fmt.Errorf("dynamo: unable to read the %s items: %w", db.name(t), err)
+	}
+	return reason, nil
+}
+
+// total counts the items matching the search
+func (db *DB) total(ctx context.Context, t *Table, s search) (int, error) {
+	read, _, err := db.plan(ctx, t, s)
+	if err != nil {
+		return 0, err
+	}
+	return db.count(ctx, t, s.signature, read)
+}
+
+// save creates or updates the item of result, a pointer to a struct of the
+// table, on behalf of the user by. Every attribute is written, the nil ones
+// are removed.
+//
+// A create fails if the key exists, an update if the item was deleted or
+// trashed or, with a version field, if it was saved since result was loaded.
+// The version is then set to the stored one so saving result again
+// overwrites the item.
+func (db *DB) save(ctx context.Context, t *Table, result interface{}, create bool, by string) (err error) {
+	v, err := t.value(result)
+	if err != nil {
+		return err
+	}
+	if err := t.prepare(v, time.Now()); err != nil {
+		return err
+	}
+	var loaded int64
+	if t.version != nil {
+		version := v.FieldByIndex(t.version.index)
+		loaded = version.Int()
+		version.SetInt(loaded + 1)
+		defer func() {
+			if err != nil && !errors.As(err, new(*ConflictError)) {
+				version.SetInt(loaded)
+			}
+		}()
+	}
+	item, err := t.item(v)
+	if err != nil {
+		return err
+	}
+	if by != "" {
+		item[updatedByAttribute] = &dynamodb.AttributeValue{S: aws.String(by)}
+	}
+
+	key := map[string]*dynamodb.AttributeValue{t.hash.name: item[t.hash.name]}
+	delete(item, t.hash.name)
+	var e expression
+	input := &dynamodb.UpdateItemInput{
+		TableName:              aws.String(db.name(t)),
+		Key:                    key,
+		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+	if expr := e.update(item); expr != "" {
+		input.UpdateExpression = aws.String(expr)
+	}
+	switch hash := e.name(t.hash.name); {
+	case create:
+		input.ConditionExpression = aws.String("attribute_not_exists(" + hash + ")")
+	case t.version != nil && loaded == 0:
+		// saved before the version field was added
+		input.ConditionExpression = aws.String("attribute_exists(" + hash + ") AND attribute_not_exists(" + e.name(t.version.name) + ")")
+	case t.version != nil:
+		input.ConditionExpression = aws.String("attribute_exists(" + hash + ") AND " + e.name(t.version.name) + " = " +
+			e.value(&dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(loaded, 10))}))
+	default:
+		input.ConditionExpression = aws.String("attribute_exists(" + hash + ")")
+	}
+	if !create && t.deletedAt != nil {
+		input.ConditionExpression = aws.String(*input.ConditionExpression + " AND " + e.condition(condition{field: *t.deletedAt, op: "blank"}))
+	}
+	input.ExpressionAttributeNames = e.names
+	input.ExpressionAttributeValues = e.values
+
+	defer db.cursors.flush(t.Name)
+	err = db.call(ctx, db.name(t), "Save", "UpdateItem", func(ctx context.Context) (*dynamodb.ConsumedCapacity, error) {
+		out, err := db.svc.UpdateItemWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		return out.ConsumedCapacity, nil
+	})
+	if !conditionFailed(err) {
+		return err
+	}
+	if create {
+		return validations.NewError(result, t.hash.goName, "A record with this "+t.hash.goName+" already exists")
+	}
+	return db.conflict(ctx, t, key, v)
+}
+
+// conflict returns the error of an update whose condition failed, and sets
+// the version of v to the stored one
+func (db *DB) conflict(ctx context.Context, t *Table, key map[string]*dynamodb.AttributeValue, v reflect.Value) error {
+	var out *dynamodb.GetItemOutput
+	err := db.call(ctx, db.name(t), "Save", "GetItem", func(ctx context.Context) (cc *dynamodb.ConsumedCapacity, err error) {
+		out, err = db.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:              aws.String(db.name(t)),
+			Key:                    key,
+			ConsistentRead:         aws.Bool(true),
+			ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return out.ConsumedCapacity, nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(out.Item) == 0 || t.deleted(out.Item) {
+		return &ConflictError{Deleted: true}
+	}
+	conflict := &ConflictError{}
+	if by := out.Item[updatedByAttribute]; by != nil {
+		conflict.By = aws.StringValue(by.S)
+	}
+	if t.version != nil {
+		var version int64
+		if av := out.Item[t.version.name]; av != nil {
+			version, _ = strconv.ParseInt(aws.StringValue(av.N), 10, 64)
+		}
+		v.FieldByIndex(t.version.index).SetInt(version)
+	}
+	return conflict
+}
+
+// delete removes the item
+func (db *DB) delete(ctx context.Context, t *Table, id string) error {
+	key := t.key(id)
+	if key == nil {
+		return gorm.ErrRecordNotFound
+	}
+	var e expression
+	defer db.cursors.flush(t.Name)
+	err := db.call(ctx, db.name(t), "Delete", "DeleteItem", func(ctx context.Context) (*dynamodb.ConsumedCapacity, error) {
+		out, err := db.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName:                aws.String(db.name(t)),
+			Key:                      key,
+			ConditionExpression:      aws.String("attribute_exists(" + e.name(t.hash.name) + ")"),
+			ExpressionAttributeNames: e.names,
+			ReturnConsumedCapacity:   aws.String(dynamodb.ReturnConsumedCapacityTotal),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return out.ConsumedCapacity, nil
+	})
+	if conditionFailed(err) {
+		return gorm.ErrRecordNotFound
+	}
+	return err
+}
@@ -0,0 +1,396 @@
+package dynamo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// kindAttribute is the partition key of the sort indexes, it holds the type
+// name of the model in every item so an index sorts the whole table
+const kindAttribute = "_kind"
+
+// Table is the DynamoDB table of a model. The attributes are named after the
+// dynamodbav tags, or the field names, and the hash key is the field tagged
+// dynamo:"hash", or the ID field.
+//
+// The field tagged dynamo:"ttl" is the expiry time of the items, deleted by
+// DynamoDB once passed.
+//
+// The field tagged dynamo:"version", an integer, enables the optimistic
+// concurrency control of the saves, see ConflictError.
+//
+// A DeletedAt *time.Time field enables the soft deletes, see DB.Trash. The
+// user who deleted the item is stored in the DeletedBy string field, if any.
+//
+// The fields tagged dynamo:"index" get a global secondary index, named after
+// the attribute, ex. "TotalIndex", used to sort the listings and to query
+// ranges of the attribute instead of scanning the table. Every item of the
+// table has the same _kind partition key in these indexes, so each index is
+// a single partition, limited to about 1000 write and 3000 read units per
+// second: every write to the table is also a write to each index. Only
+// index the tables of the admin, not those written by the application at a
+// high rate.
+//
+//	type Order struct {
+//		Ref       string `dynamo:"hash" dynamodbav:"ref"`
+//		Total     int64  `dynamo:"index" dynamodbav:"total"`
+//		Version   int64  `dynamo:"version"`
+//		CreatedAt time.Time
+//		UpdatedAt time.Time
+//	}
+type Table struct {
+	Name string
+
+	// BillingMode of the table when it's created, PAY_PER_REQUEST by default.
+	// The capacities are those of the table and its indexes in PROVISIONED mode.
+	BillingMode   string
+	ReadCapacity  int64
+	WriteCapacity int64
+
+	// Migrations are applied in order by Provision, see Migration
+	Migrations []Migration
+
+	typ   reflect.Type
+	codec *codec
+
+	hash      field
+	fields    []field
+	indexes   []field // fields with a sort index
+	version   *field
+	ttl       *field
+	createdAt []int // index of the CreatedAt time.Time field, if any
+	updatedAt []int
+	deletedAt *field
+	deletedBy string // attribute of the user who deleted the item
+}
+
+// field is a struct field stored as an attribute
+type field struct {
+	index  []int
+	name   string // attribute name
+	goName string
+	kind   string // scalar attribute type, ex. dynamodb.ScalarAttributeTypeS, empty for the others
+}
+
+// indexName is the name of the sort index of the field
+func (f field) indexName() string {
+	return f.name + "Index"
+}
+
+// NewTable derives the table of the model, value is a pointer to a struct.
+// The name defaults to the plural of the type name, ex. "Customers".
+func NewTable(value interface{}, name string) (*Table, error) {
+	typ := reflect.TypeOf(value)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("dynamo: %T is not a struct", value)
+	}
+	if name == "" {
+		name = typ.Name() + "s"
+	}
+	t := Table{Name: name, BillingMode: dynamodb.BillingModePayPerRequest, typ: typ, codec: codecOf(typ)}
+
+	var id *field
+	t.fields = fields(typ, nil)
+	for _, f := range t.fields {
+		f := f
+		sf := typ.FieldByIndex(f.index)
+		switch sf.Tag.Get("dynamo") {
+		case "hash":
+			if t.hash.index != nil {
+				return nil, fmt.Errorf("dynamo: %s has more than one hash key", typ.Name())
+			}
+			t.hash = f
+		case "index":
+			if f.kind != dynamodb.ScalarAttributeTypeS && f.kind != dynamodb.ScalarAttributeTypeN {
+				return nil, fmt.Errorf("dynamo: %s.%s: only strings, numbers and times can be indexed", typ.Name(), sf.Name)
+			}
+			t.indexes = append(t.indexes, f)
+		case "version":
+			if f.kind != dynamodb.ScalarAttributeTypeN || sf.Type.Kind() < reflect.Int || sf.Type.Kind() > reflect.Int64 {
+				return nil, fmt.Errorf("dynamo: %s.%s: the version must be an integer", typ.Name(), sf.Name)
+			}
+			t.version = &f
+		case "ttl":
+			if f.kind != dynamodb.ScalarAttributeTypeN {
+				return nil, fmt.Errorf("dynamo: %s.%s: the TTL must be a number of seconds, or a time tagged dynamodbav:\",unixtime\"", typ.Name(), sf.Name)
+			}
+			t.ttl = &f
+		case "range":
+			return nil, fmt.Errorf("dynamo: %s.%s: range keys are not supported", typ.Name(), sf.Name)
+		}
+		if sf.Name == "ID" {
+			id = &f
+		}
+		if sf.Type == timeType && sf.Name == "CreatedAt" {
+			t.createdAt = f.index
+		}
+		if sf.Type == timeType && sf.Name == "UpdatedAt" {
+			t.updatedAt = f.index
+		}
+		if sf.Type == reflect.PtrTo(timeType) && sf.Name == "DeletedAt" {
+			t.deletedAt = &f
+		}
+		if sf.Type.Kind() == reflect.String && sf.Name == "DeletedBy" {
+			t.deletedBy = f.name
+		}
+	}
+	if t.hash.index == nil {
+		if id == nil {
+			return nil, fmt.Errorf("dynamo: %s has no hash key, tag a field with dynamo:\"hash\" or add an ID field", typ.Name())
+		}
+		t.hash = *id
+	}
+
+	switch kind := typ.FieldByIndex(t.hash.index).Type.Kind(); {
+	case kind == reflect.String, kind >= reflect.Int && kind <= reflect.Uint64:
+	default:
+		return nil, fmt.Errorf("dynamo: %s: the hash key must be a string or a number", typ.Name())
+	}
+	if t.deletedAt != nil && t.deletedBy == "" {
+		t.deletedBy = deletedByAttribute
+	}
+	if d, ok := reflect.New(typ).Interface().(Definer); ok {
+		d.DefineTable(&t)
+	}
+	return &t, nil
+}
+
+// Definer is implemented by the models setting up their table beyond the
+// struct tags, ex. its migrations or billing mode
+type Definer interface {
+	DefineTable(t *Table)
+}
+
+// kindOf returns the scalar attribute type a field type is stored as, times
+// are RFC 3339 strings
+func kindOf(typ reflect.Type) string {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch kind := typ.Kind(); {
+	case typ == timeType, kind == reflect.String:
+		return dynamodb.ScalarAttributeTypeS
+	case kind >= reflect.Int && kind <= reflect.Float64:
+		return dynamodb.ScalarAttributeTypeN
+	case kind == reflect.Bool:
+		return "BOOL"
+	}
+	return ""
+}
+
+// MustTable is like NewTable but panics on error, for package level tables
+func MustTable(value interface{}, name string) *Table {
+	t, err := NewTable(value, name)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// fields lists the stored fields of typ, the embedded structs are flattened
+// like dynamodbattribute does
+func fields(typ reflect.Type, index []int) []field {
+	var list []field
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		opts := strings.Split(sf.Tag.Get("dynamodbav"), ",")
+		tag := opts[0]
+		if tag == "-" || (sf.PkgPath != "" && !sf.Anonymous) {
+			continue
+		}
+		idx := append(append([]int{}, index...), i)
+		if sf.Anonymous && tag == "" && sf.Type.Kind() == reflect.Struct {
+			list = append(list, fields(sf.Type, idx)...)
+			continue
+		}
+		name := sf.Name
+		if tag != "" {
+			name = tag
+		}
+		f := field{index: idx, name: name, goName: sf.Name, kind: kindOf(sf.Type)}
+		for _, opt := range opts[1:] {
+			if opt == "unixtime" {
+				f.kind = dynamodb.ScalarAttributeTypeN
+			}
+		}
+		list = append(list, f)
+	}
+	return list
+}
+
+// HashKey returns the attribute name of the hash key
+func (t *Table) HashKey() string {
+	return t.hash.name
+}
+
+// SoftDeletes reports if the deleted items go to the trash, see DB.Trash
+func (t *Table) SoftDeletes() bool {
+	return t.deletedAt != nil
+}
+
+// trashed reports if the model, a pointer to a struct of the table, is in the
+// trash
+func (t *Table) trashed(model interface{}) bool {
+	v, err := t.value(model)
+	return err == nil && t.deletedAt != nil && !v.FieldByIndex(t.deletedAt.index).IsNil()
+}
+
+// field returns the stored field named name, the Go or the attribute name
+func (t *Table) field(name string) (field, bool) {
+	for _, f := range t.fields {
+		if strings.EqualFold(f.goName, name) || strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// sortIndex returns the sort index of the field
+func (t *Table) sortIndex(f field) bool {
+	for _, i := range t.indexes {
+		if i.name == f.name {
+			return true
+		}
+	}
+	return false
+}
+
+// sparse reports if the field can be blank. Its blank attributes are
+// removed, so its sort index misses these items.
+func (t *Table) sparse(f field) bool {
+	sf := t.typ.FieldByIndex(f.index)
+	if strings.Contains(sf.Tag.Get("dynamodbav"), "omitempty") {
+		return true
+	}
+	switch sf.Type.Kind() {
+	case reflect.Ptr, reflect.String:
+		return true
+	}
+	return false
+}
+
+// key returns the primary key of the item identified by the qor resource ID,
+// nil if the ID isn't a valid key
+func (t *Table) key(id string) map[string]*dynamodb.AttributeValue {
+	if id == "" {
+		return nil
+	}
+	av := &dynamodb.AttributeValue{}
+	if t.hash.kind == dynamodb.ScalarAttributeTypeN {
+		if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+			return nil
+		}
+		av.N = aws.String(id)
+	} else {
+		av.S = aws.String(id)
+	}
+	return map[string]*dynamodb.AttributeValue{t.hash.name: av}
+}
+
+// prepare fills the hash key of a new item and its timestamps, v is the
+// addressable struct
+func (t *Table) prepare(v reflect.Value, now time.Time) error {
+	hash := v.FieldByIndex(t.hash.index)
+	if hash.IsZero() {
+		if hash.Kind() != reflect.String {
+			return fmt.Errorf("dynamo: the %s key of %s is required", t.hash.name, t.typ.Name())
+		}
+		hash.SetString(uuid.New().String())
+	}
+	if t.createdAt != nil && v.FieldByIndex(t.createdAt).Interface().(time.Time).IsZero() {
+		v.FieldByIndex(t.createdAt).Set(reflect.ValueOf(now))
+	}
+	if t.updatedAt != nil {
+		v.FieldByIndex(t.updatedAt).Set(reflect.ValueOf(now))
+	}
+	return nil
+}
+
+// item marshals the addressable struct, with the partition key of the sort
+// indexes
+func (t *Table) item(v reflect.Value) (map[string]*dynamodb.AttributeValue, error) {
+	item, err := t.codec.marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("dynamo: %w", err)
+	}
+	if len(t.indexes) > 0 {
+		item[kindAttribute] = &dynamodb.AttributeValue{S: aws.String(t.typ.Name())}
+	}
+	return item, nil
+}
+
+// value returns the addressable struct of a model pointer
+func (t *Table) value(model interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(model)
+	for v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Type() != t.typ {
+		return reflect.Value{}, fmt.Errorf("dynamo: expected a *%s, got %T", t.typ.Name(), model)
+	}
+	return v.Elem(), nil
+}
+
+// Put writes the model, a pointer to a struct of the table, replacing the
+// item with the same key. The hash key and timestamps are filled as on save.
+func (db *DB) Put(ctx context.Context, t *Table, model interface{}) error {
+	v, err := t.value(model)
+	if err != nil {
+		return err
+	}
+	if err := t.prepare(v, time.Now()); err != nil {
+		return err
+	}
+	item, err := t.item(v)
+	if err != nil {
+		return err
+	}
+	item = withoutNulls(item)
+	defer db.cursors.flush(t.Name)
+	return db.call(ctx, db.name(t), "Put", "PutItem", func(ctx context.Context) (*dynamodb.ConsumedCapacity, error) {
+		out, err := db.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:              aws.String(db.name(t)),
+			Item:                   item,
+			ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return out.ConsumedCapacity, nil
+	})
+}
+
+// withoutNulls leaves out the NULL attributes of an item before a put, like
+// save removes them: an index key must be absent, not NULL
+func withoutNulls(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	for attr, av := range item {
+		if av.NULL != nil && *av.NULL {
+			delete(item, attr)
+		}
+	}
+	return item
+}
+
+// Check returns a function reporting if the table can be described, for the
+// readiness probe
+func (db *DB) Check(t *Table) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := db.svc.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(db.name(t)),
+		})
+		return err
+	}
+}
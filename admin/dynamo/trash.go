@@ -0,0 +1,224 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/roles"
+	"github.com/sirupsen/logrus"
+
+	"qor-admin-3/admin/logging"
+)
+
+// TrashScope is the qor scope listing the soft deleted items
+const TrashScope = "Trash"
+
+// deletedByAttribute holds the display name of the user who deleted the item,
+// when the model has no DeletedBy field
+const deletedByAttribute = "_deletedBy"
+
+// Trash soft deletes the item on behalf of the user by: it sets its
+// DeletedAt and bumps its version, so the forms loaded before fail to save
+// it. The trashed items are left out of the listings and lookups until
+// Restore, and removed by Purge.
+func (db *DB) Trash(ctx context.Context, t *Table, id, by string) error {
+	if t.deletedAt == nil {
+		return gorm.ErrRecordNotFound
+	}
+	var e expression
+	set := e.name(t.deletedAt.name) + " = " + e.value(timeValue(*t.deletedAt, time.Now()))
+	if by != "" {
+		set += ", " + e.name(t.deletedBy) + " = " + e.value(&dynamodb.AttributeValue{S: aws.String(by)})
+	}
+	return db.updateTrash(ctx, t, "Delete", id, &e, "SET "+set, "blank")
+}
+
+// Restore takes the item out of the trash
+func (db *DB) Restore(ctx context.Context, t *Table, id string) error {
+	if t.deletedAt == nil {
+		return gorm.ErrRecordNotFound
+	}
+	var e expression
+	remove := "REMOVE " + e.name(t.deletedAt.name) + ", " + e.name(t.deletedBy)
+	return db.updateTrash(ctx, t, "Restore", id, &e, remove, "present")
+}
+
+// updateTrash applies the update to the item if its DeletedAt is blank or
+// present, and bumps its version. It returns gorm.ErrRecordNotFound if the
+// item doesn't exist or is in the other state.
+func (db *DB) updateTrash(ctx context.Context, t *Table, handler, id string, e *expression, update, state string) error {
+	key := t.key(id)
+	if key == nil {
+		return gorm.ErrRecordNotFound
+	}
+	if t.version != nil {
+		update += " ADD " + e.name(t.version.name) + " " + e.value(&dynamodb.AttributeValue{N: aws.String("1")})
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName:              aws.String(db.name(t)),
+		Key:                    key,
+		UpdateExpression:       aws.String(update),
+		ConditionExpression:    aws.String("attribute_exists(" + e.name(t.hash.name) + ") AND " + e.condition(condition{field: *t.deletedAt, op: state})),
+		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+	input.ExpressionAttributeNames = e.names
+	input.ExpressionAttributeValues = e.values
+
+	defer db.cursors.flush(t.Name)
+	err := db.call(ctx, db.name(t), handler, "UpdateItem", func(ctx context.Context) (*dynamodb.ConsumedCapacity, error) {
+		out, err := db.svc.UpdateItemWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		return out.ConsumedCapacity, nil
+	})
+	if conditionFailed(err) {
+		return gorm.ErrRecordNotFound
+	}
+	return err
+}
+
+// deleted reports if the item is in the trash
+func (t *Table) deleted(item map[string]*dynamodb.AttributeValue) bool {
+	if t.deletedAt == nil {
+		return false
+	}
+	av := item[t.deletedAt.name]
+	return av != nil && av.NULL == nil
+}
+
+// Purge removes the item if it's in the trash
+func (db *DB) Purge(ctx context.Context, t *Table, id string) error {
+	if t.deletedAt == nil {
+		return gorm.ErrRecordNotFound
+	}
+	return db.purge(ctx, t, t.key(id), condition{field: *t.deletedAt, op: "present"})
+}
+
+// PurgeBefore removes the items trashed before the time and returns how many
+// were removed
+func (db *DB) PurgeBefore(ctx context.Context, t *Table, before time.Time) (int, error) {
+	if t.deletedAt == nil {
+		return 0, nil
+	}
+	expired := condition{field: *t.deletedAt, op: "<", values: []*dynamodb.AttributeValue{timeValue(*t.deletedAt, before)}}
+	var e expression
+	read := db.scan(t, dynamodb.ScanInput{
+		FilterExpression:          aws.String(e.condition(expired)),
+		ProjectionExpression:      aws.String(e.name(t.hash.name)),
+		ExpressionAttributeNames:  e.names,
+		ExpressionAttributeValues: e.values,
+	})
+	var purged int
+	var start map[string]*dynamodb.AttributeValue
+	for {
+		out, err := read(ctx, start, 0, false)
+		if err != nil {
+			return purged, err
+		}
+		for _, key := range out.items {
+			// the condition keeps the items restored meanwhile
+			err := db.purge(ctx, t, key, expired)
+			switch {
+			case err == nil:
+				purged++
+			case !errors.Is(err, gorm.ErrRecordNotFound):
+				return purged, err
+			}
+		}
+		if start = out.last; start == nil {
+			return purged, nil
+		}
+	}
+}
+
+// purge deletes the item with the key if it matches the condition
+func (db *DB) purge(ctx context.Context, t *Table, key map[string]*dynamodb.AttributeValue, c condition) error {
+	if key == nil {
+		return gorm.ErrRecordNotFound
+	}
+	var e expression
+	input := &dynamodb.DeleteItemInput{
+		TableName:              aws.String(db.name(t)),
+		Key:                    key,
+		ConditionExpression:    aws.String(e.condition(c)),
+		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+	input.ExpressionAttributeNames = e.names
+	input.ExpressionAttributeValues = e.values
+
+	defer db.cursors.flush(t.Name)
+	err := db.call(ctx, db.name(t), "Purge", "DeleteItem", func(ctx context.Context) (*dynamodb.ConsumedCapacity, error) {
+		out, err := db.svc.DeleteItemWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		return out.ConsumedCapacity, nil
+	})
+	if conditionFailed(err) {
+		return gorm.ErrRecordNotFound
+	}
+	return err
+}
+
+// configureTrash adds the Trash scope to the resource, with the actions
+// restoring and purging its records. The forms leave DeletedAt out, a
+// record is trashed by deleting it.
+func (db *DB) configureTrash(res *admin.Resource, t *Table) {
+	// the listings read the scope from the request, see searchOf
+	res.Scope(&admin.Scope{Name: TrashScope, Handler: func(db *gorm.DB, ctx *qor.Context) *gorm.DB {
+		return db
+	}})
+	exclude := []interface{}{"-" + t.deletedAt.goName}
+	if f, ok := t.field(t.deletedBy); ok {
+		exclude = append(exclude, "-"+f.goName)
+	}
+	res.EditAttrs(exclude...)
+	res.NewAttrs(exclude...)
+
+	trashed := func(record interface{}, ctx *admin.Context) bool {
+		return t.trashed(record)
+	}
+	res.Action(&admin.Action{
+		Name:    "Restore",
+		Modes:   []string{"menu_item"},
+		Visible: trashed,
+		Handler: func(arg *admin.ActionArgument) error {
+			return db.trashAction(res, t, arg, "Record restored", "Couldn't restore the record", db.Restore)
+		},
+	})
+	res.Action(&admin.Action{
+		Name:    "Purge",
+		Label:   "Delete permanently",
+		Modes:   []string{"menu_item"},
+		Visible: trashed,
+		Handler: func(arg *admin.ActionArgument) error {
+			return db.trashAction(res, t, arg, "Record purged", "Couldn't purge the record", db.Purge)
+		},
+	})
+}
+
+// trashAction applies fn, Restore or Purge, to the records of the action
+func (db *DB) trashAction(res *admin.Resource, t *Table, arg *admin.ActionArgument, done, failed string, fn func(ctx context.Context, t *Table, id string) error) error {
+	ctx := arg.Context.Context
+	if !res.HasPermission(roles.Delete, ctx) {
+		return roles.ErrPermissionDenied
+	}
+	table := db.name(t)
+	for _, id := range arg.PrimaryValues {
+		if err := fn(ctx.Request.Context(), t, id); err != nil {
+			return report(ctx, table, failed, qorError(table, err))
+		}
+		logging.FromContext(ctx.Request.Context()).WithFields(logrus.Fields{
+			"dynamodb_table": table,
+			"id":             id,
+		}).Info(done)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkFunc reports if a backend of the admin is usable
+type checkFunc func(ctx context.Context) error
+
+// healthCheck runs a readiness check and caches its result, so frequent
+// probes don't overload the backend
+type healthCheck struct {
+	name string
+	run  checkFunc
+
+	mu     sync.Mutex
+	result checkResult
+	at     time.Time
+}
+
+// checkResult is the JSON detail of a readiness check
+type checkResult struct {
+	Status    string    `json:"status"` // "ok" or "error"
+	Error     string    `json:"error,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// health holds the readiness checks of the admin
+type health struct {
+	timeout time.Duration
+	ttl     time.Duration
+	checks  []*healthCheck
+}
+
+func newHealth(cfg HealthConfig) *health {
+	return &health{timeout: cfg.Timeout, ttl: cfg.CacheTTL}
+}
+
+// add registers a readiness check, a check already registered under the same
+// name is kept
+func (h *health) add(name string, run checkFunc) {
+	for _, check := range h.checks {
+		if check.name == name {
+			return
+		}
+	}
+	h.checks = append(h.checks, &healthCheck{name: name, run: run})
+}
+
+// get returns the cached result of the check, or runs it when it's
+// expired. Concurrent probes wait for the running check instead of starting
+// their own.
+func (c *healthCheck) get(timeout, ttl time.Duration) checkResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.at.IsZero() && time.Since(c.at) < ttl {
+		return c.result
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	// some clients (ex. LDAP) don't take a context, the check is abandoned
+	// on timeout
+	go func() { done <- c.run(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.result = checkResult{
+		Status:    "ok",
+		LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+		CheckedAt: start,
+	}
+	if err != nil {
+		c.result.Status = "error"
+		c.result.Error = err.Error()
+	}
+	c.at = time.Now()
+	return c.result
+}
+
+// Healthz is the liveness probe, it only tells the process is serving
+func (h *health) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz is the readiness probe, it runs every check concurrently and answers
+// 503 when one of them fails
+func (h *health) Readyz(c *gin.Context) {
+	results := make([]checkResult, len(h.checks))
+	var wg sync.WaitGroup
+	for i, check := range h.checks {
+		wg.Add(1)
+		go func(i int, check *healthCheck) {
+			defer wg.Done()
+			results[i] = check.get(h.timeout, h.ttl)
+		}(i, check)
+	}
+	wg.Wait()
+
+	status, code := "ok", http.StatusOK
+	checks := make(map[string]checkResult, len(h.checks))
+	for i, check := range h.checks {
+		checks[check.name] = results[i]
+		if results[i].Status != "ok" {
+			status, code = "error", http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
@@ -4,6 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/ldap.v3"
@@ -12,15 +15,54 @@ import (
 // Client interface performs ldap auth operation
 type Client interface {
 	Auth(username, password string) error
+	LookupDN(dn string) (Entry, error)
+	Lookup(username string) (Entry, error)
+	Users() ([]Entry, error)
+	Groups() ([]Group, error)
+	Ping() error
+	Close() error
 }
 
+// Entry is the subset of a directory entry used by the admin
+type Entry struct {
+	DN        string
+	UID       string
+	Mail      string
+	GivenName string
+	Surname   string
+	Groups    []string
+	Disabled  bool // locked or disabled account
+}
+
+// Group is a directory group and the DNs of its members
+type Group struct {
+	DN      string
+	Name    string
+	Members []string
+}
+
+// ErrInvalidCredentials is returned by Auth when the user is unknown or the
+// password is wrong
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// attributes fetched for an Entry
+var entryAttributes = []string{"uid", "mail", "givenName", "sn", "memberOf", "userAccountControl", "nsAccountLock"}
+
+// userAccountControl flag of disabled Active Directory accounts
+const accountDisable = 0x2
+
 // Config to provide a dappy client.
 // All fields are required, except for Filter.
 type Config struct {
-	BaseDN string // base directory, ex. "CN=Users,DC=Company"
-	ROUser User   // the read-only user for initial bind
-	Host   string // the ldap host and port, ex. "ldap.directory.com:389"
-	Filter string // defaults to "sAMAccountName" for AD
+	BaseDN      string // base directory, ex. "CN=Users,DC=Company"
+	ROUser      User   // the read-only user for initial bind
+	Host        string // the ldap host and port, ex. "ldap.directory.com:389"
+	Filter      string // defaults to "sAMAccountName" for AD
+	UserFilter  string // filter listing the users, defaults to "(objectClass=person)"
+	GroupBaseDN string // base directory of the groups, defaults to BaseDN
+	GroupFilter string // filter listing the groups, defaults to "(objectClass=groupOfNames)"
+	PageSize    uint32 // page size of the listings, defaults to 500
+	PoolSize    int    // idle connections kept open, defaults to 4
 }
 
 // User holds the name and pass required for initial read-only bind.
@@ -32,19 +74,60 @@ type User struct {
 // local struct for implementing Client interface
 type client struct {
 	Config
+	pool chan *ldap.Conn
+
+	mu     sync.Mutex
+	closed bool
 }
 
-// Auth implementation for the Client interface
-func (c client) Auth(username, password string) error {
-	// establish connection
+// conn returns a connection bound with the read-only user, reusing an idle
+// one from the pool when possible
+func (c *client) conn() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-c.pool:
+			if !conn.IsClosing() {
+				return conn, nil
+			}
+			conn.Close()
+			continue
+		default:
+		}
+		break
+	}
+
 	conn, err := connect(c.Host)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer conn.Close()
-
 	// perform initial read-only bind
 	if err = conn.Bind(c.ROUser.Name, c.ROUser.Pass); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// release gives back a connection bound with the read-only user to the
+// pool, it is closed when the pool is full or the client closed
+func (c *client) release(conn *ldap.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Auth implementation for the Client interface
+func (c *client) Auth(username, password string) error {
+	conn, err := c.conn()
+	if err != nil {
 		return err
 	}
 
@@ -52,18 +135,166 @@ func (c client) Auth(username, password string) error {
 	results, err := conn.Search(ldap.NewSearchRequest(
 		c.BaseDN, ldap.ScopeWholeSubtree,
 		ldap.NeverDerefAliases,
-		0, 0, false, fmt.Sprintf("(%v=%v)", c.Filter, username),
+		0, 0, false, fmt.Sprintf("(%v=%v)", c.Filter, ldap.EscapeFilter(username)),
 		[]string{}, nil,
 	))
 	if err != nil {
+		conn.Close()
 		return err
 	}
 	if len(results.Entries) < 1 {
-		return errors.New("not found")
+		c.release(conn)
+		return ErrInvalidCredentials
 	}
 
-	// attempt auth
-	return conn.Bind(results.Entries[0].DN, password)
+	// attempt auth, then restore the read-only bind before the connection
+	// goes back to the pool
+	authErr := conn.Bind(results.Entries[0].DN, password)
+	if err = conn.Bind(c.ROUser.Name, c.ROUser.Pass); err != nil {
+		conn.Close()
+	} else {
+		c.release(conn)
+	}
+	if ldap.IsErrorWithCode(authErr, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return authErr
+}
+
+// Lookup implementation for the Client interface, it finds the user by their
+// login attribute, see Config.Filter
+func (c *client) Lookup(username string) (Entry, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	results, err := conn.Search(ldap.NewSearchRequest(
+		c.BaseDN, ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0, 0, false, fmt.Sprintf("(%v=%v)", c.Filter, ldap.EscapeFilter(username)),
+		entryAttributes, nil,
+	))
+	if err != nil {
+		conn.Close()
+		return Entry{}, err
+	}
+	c.release(conn)
+	if len(results.Entries) < 1 {
+		return Entry{}, errors.New("not found")
+	}
+	return newEntry(results.Entries[0]), nil
+}
+
+// LookupDN implementation for the Client interface, it reads the entry
+// located at the provided DN
+func (c *client) LookupDN(dn string) (Entry, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	results, err := conn.Search(ldap.NewSearchRequest(
+		dn, ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		1, 0, false, "(objectClass=*)",
+		entryAttributes, nil,
+	))
+	if err != nil {
+		conn.Close()
+		return Entry{}, err
+	}
+	c.release(conn)
+	if len(results.Entries) < 1 {
+		return Entry{}, errors.New("not found")
+	}
+	return newEntry(results.Entries[0]), nil
+}
+
+// Ping implementation for the Client interface, it checks the read-only bind
+func (c *client) Ping() error {
+	conn, err := c.conn()
+	if err != nil {
+		return err
+	}
+	if err = conn.Bind(c.ROUser.Name, c.ROUser.Pass); err != nil {
+		conn.Close()
+		return err
+	}
+	c.release(conn)
+	return nil
+}
+
+// Close implementation for the Client interface, it closes the idle
+// connections of the pool
+func (c *client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Users implementation for the Client interface, it pages through all the
+// users matching UserFilter
+func (c *client) Users() ([]Entry, error) {
+	results, err := c.search(c.BaseDN, c.UserFilter, entryAttributes)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(results))
+	for _, e := range results {
+		entries = append(entries, newEntry(e))
+	}
+	return entries, nil
+}
+
+// Groups implementation for the Client interface, it pages through all the
+// groups matching GroupFilter
+func (c *client) Groups() ([]Group, error) {
+	results, err := c.search(c.GroupBaseDN, c.GroupFilter, []string{"cn", "member", "uniqueMember"})
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]Group, 0, len(results))
+	for _, e := range results {
+		groups = append(groups, Group{
+			DN:      e.DN,
+			Name:    e.GetAttributeValue("cn"),
+			Members: append(e.GetAttributeValues("member"), e.GetAttributeValues("uniqueMember")...),
+		})
+	}
+	return groups, nil
+}
+
+// search runs a paged subtree search with the read-only user
+func (c *client) search(baseDN, filter string, attributes []string) ([]*ldap.Entry, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := conn.SearchWithPaging(ldap.NewSearchRequest(
+		baseDN, ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0, 0, false, filter,
+		attributes, nil,
+	), c.PageSize)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.release(conn)
+	return results.Entries, nil
 }
 
 // New dappy client with the provided config
@@ -75,15 +306,12 @@ func New(config Config) (Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	c := client{config}
-	conn, err := connect(c.Host) // test connection
+	c := &client{Config: config, pool: make(chan *ldap.Conn, config.PoolSize)}
+	conn, err := c.conn() // test connection
 	if err != nil {
 		return nil, err
 	}
-	if err = conn.Bind(c.ROUser.Name, c.ROUser.Pass); err != nil {
-		return nil, err
-	}
-	conn.Close()
+	c.release(conn)
 	return c, err
 }
 
@@ -101,8 +329,29 @@ func connect(host string) (*ldap.Conn, error) {
 	return conn, nil
 }
 
+// converts a search result to an Entry
+func newEntry(e *ldap.Entry) Entry {
+	return Entry{
+		DN:        e.DN,
+		UID:       e.GetAttributeValue("uid"),
+		Mail:      e.GetAttributeValue("mail"),
+		GivenName: e.GetAttributeValue("givenName"),
+		Surname:   e.GetAttributeValue("sn"),
+		Groups:    e.GetAttributeValues("memberOf"),
+		Disabled:  disabled(e),
+	}
+}
+
+// reports if the entry is disabled in Active Directory or locked in 389-ds
+func disabled(e *ldap.Entry) bool {
+	if uac, err := strconv.Atoi(e.GetAttributeValue("userAccountControl")); err == nil && uac&accountDisable != 0 {
+		return true
+	}
+	return strings.EqualFold(e.GetAttributeValue("nsAccountLock"), "true")
+}
+
 // validates that all required fields were provided
-// handles default value for Filter
+// handles default values for Filter and the listings
 func validateConfig(config Config) (Config, error) {
 	if config.BaseDN == "" || config.Host == "" || config.ROUser.Name == "" || config.ROUser.Pass == "" {
 		return Config{}, errors.New("[CONFIG] The config provided could not be validated")
@@ -110,5 +359,20 @@ func validateConfig(config Config) (Config, error) {
 	if config.Filter == "" {
 		config.Filter = "sAMAccountName"
 	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(objectClass=person)"
+	}
+	if config.GroupBaseDN == "" {
+		config.GroupBaseDN = config.BaseDN
+	}
+	if config.GroupFilter == "" {
+		config.GroupFilter = "(objectClass=groupOfNames)"
+	}
+	if config.PageSize == 0 {
+		config.PageSize = 500
+	}
+	if config.PoolSize == 0 {
+		config.PoolSize = 4
+	}
 	return config, nil
 }
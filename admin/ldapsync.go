@@ -0,0 +1,307 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/roles"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+
+	"qor-admin-3/admin/ldap"
+	"qor-admin-3/admin/logging"
+	"qor-admin-3/admin/tracing"
+)
+
+// LDAPSyncConfig configures the scheduled synchronisation of the admin users
+// with the directory
+type LDAPSyncConfig struct {
+	LDAP       ldap.Config
+	Interval   time.Duration     // time between two runs, defaults to an hour
+	GroupRoles map[string]string // maps a directory group name (cn) to an admin role
+	DryRun     bool              // only report the changes, don't apply them
+}
+
+type ldapSync struct {
+	client     ldap.Client
+	interval   time.Duration
+	groupRoles map[string]string
+	dryRun     bool
+}
+
+// SyncReport records the outcome of a directory synchronisation
+type SyncReport struct {
+	ID         uint `gorm:"primary_key"`
+	StartedAt  time.Time
+	FinishedAt time.Time
+	DryRun     bool
+	Created    int
+	Updated    int
+	Disabled   int
+	Enabled    int
+	Unchanged  int
+	Conflicts  int // entries whose email belongs to an account the sync doesn't manage
+	Error      string
+	Details    string `sql:"type:text"`
+}
+
+// UseLDAPSync enables the scheduled synchronisation of the admin users with
+// the directory. StartJobs runs it until Close is called.
+func (a *Admin) UseLDAPSync(cfg LDAPSyncConfig) error {
+	client, err := ldap.New(cfg.LDAP)
+	if err != nil {
+		return err
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = time.Hour
+	}
+	if err := a.db.AutoMigrate(&SyncReport{}).Error; err != nil {
+		return err
+	}
+	a.sync = &ldapSync{client: a.metrics.ldap(client), interval: cfg.Interval, groupRoles: cfg.GroupRoles, dryRun: cfg.DryRun}
+	for _, role := range cfg.GroupRoles {
+		registerRole(role)
+	}
+
+	a.adm.AddResource(&SyncReport{}, &admin.Config{
+		Name:       "Directory Sync",
+		Menu:       []string{"Users"},
+		Permission: roles.Allow(roles.Read, roles.Anyone),
+	})
+
+	a.jobs = append(a.jobs, func() {
+		ticker := time.NewTicker(a.sync.interval)
+		defer ticker.Stop()
+		for {
+			if _, err := a.SyncLDAP(a.sync.dryRun); err != nil {
+				logrus.WithError(err).WithField("job", "ldap_sync").Warn("Directory sync failed")
+			}
+			select {
+			case <-ticker.C:
+			case <-a.stop:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// SyncLDAP synchronises the admin users with the directory once and records
+// the report. With dryRun, the changes are only reported.
+func (a *Admin) SyncLDAP(dryRun bool) (SyncReport, error) {
+	if a.sync == nil {
+		return SyncReport{}, errors.New("directory sync is not enabled")
+	}
+	ctx, span := tracing.Start(context.Background(), "ldap sync", attribute.Bool("ldap.dry_run", dryRun))
+	report := SyncReport{StartedAt: time.Now(), DryRun: dryRun}
+	details, err := a.sync.run(ctx, a.db, &report)
+	tracing.End(span, err)
+	report.FinishedAt = time.Now()
+	report.Details = strings.Join(details, "\n")
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if err := a.db.Create(&report).Error; err != nil {
+		logrus.WithError(err).WithField("job", "ldap_sync").Warn("Couldn't save the directory sync report")
+	}
+	return report, err
+}
+
+// run applies the directory state to the admin users and returns a line per
+// change
+func (s *ldapSync) run(ctx context.Context, db *gorm.DB, report *SyncReport) ([]string, error) {
+	client := withLog(logging.NewContext(ctx, logrus.WithField("job", "ldap_sync")), s.client)
+	entries, err := client.Users()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := client.Groups()
+	if err != nil {
+		return nil, err
+	}
+
+	// roles granted to each member DN
+	memberRoles := map[string][]string{}
+	for _, g := range groups {
+		role, ok := s.groupRoles[g.Name]
+		if !ok {
+			continue
+		}
+		for _, dn := range g.Members {
+			memberRoles[strings.ToLower(dn)] = append(memberRoles[strings.ToLower(dn)], role)
+		}
+	}
+
+	var details []string
+	seen := map[uint]bool{}
+	for _, e := range entries {
+		if e.Mail == "" || e.UID == "" {
+			continue
+		}
+		granted := memberRoles[strings.ToLower(e.DN)]
+		wanted := adminUser{
+			Email:     e.Mail,
+			Brid:      e.UID,
+			FirstName: e.GivenName,
+			LastName:  e.Surname,
+			LDAPDN:    e.DN,
+		}
+
+		// the uid is stable across renames, the email is used for users
+		// created before the first sync
+		var u adminUser
+		err := db.Where("brid = ?", e.UID).First(&u).Error
+		if gorm.IsRecordNotFoundError(err) {
+			err = db.Where("email = ?", e.Mail).First(&u).Error
+			// a local account or one linked to another entry isn't taken over
+			if err == nil && (u.LDAPDN != "" || len(u.Password) > 0) {
+				report.Conflicts++
+				details = append(details, fmt.Sprintf("conflict %s (%s): the email belongs to another account", e.Mail, e.DN))
+				continue
+			}
+		}
+		switch {
+		case gorm.IsRecordNotFoundError(err):
+			if e.Disabled {
+				continue
+			}
+			wanted.Roles = s.roles("", granted)
+			report.Created++
+			details = append(details, fmt.Sprintf("create %s (%s)", e.Mail, e.DN))
+			if !report.DryRun {
+				if err := db.Create(&wanted).Error; err != nil {
+					return details, err
+				}
+				seen[wanted.ID] = true
+			}
+			continue
+		case err != nil:
+			return details, err
+		}
+		seen[u.ID] = true
+
+		// the directory is authoritative for the users it manages, only those
+		// disabled by a previous sync are enabled again
+		wanted.Roles = s.roles(u.Roles, granted)
+		changes := diffUser(u, wanted)
+		disable := e.Disabled && !u.Disabled
+		enable := !e.Disabled && u.Disabled && u.DisabledBySync
+		switch {
+		case disable:
+			changes = append(changes, "disabled in directory")
+		case enable:
+			changes = append(changes, "enabled in directory")
+		}
+		if len(changes) == 0 {
+			report.Unchanged++
+			continue
+		}
+		details = append(details, fmt.Sprintf("update %s: %s", u.Email, strings.Join(changes, ", ")))
+		switch {
+		case disable:
+			report.Disabled++
+		case enable:
+			report.Enabled++
+		default:
+			report.Updated++
+		}
+		if report.DryRun {
+			continue
+		}
+		if err := db.Model(&u).Updates(map[string]interface{}{
+			"email":      wanted.Email,
+			"brid":       wanted.Brid,
+			"first_name": wanted.FirstName,
+			"last_name":  wanted.LastName,
+			"roles":      wanted.Roles,
+			"ldap_dn":    wanted.LDAPDN,
+		}).Error; err != nil {
+			return details, err
+		}
+		if disable || enable {
+			if err := setActiveBy(db, &u, enable, true); err != nil {
+				return details, err
+			}
+		}
+	}
+
+	// users which came from the directory but aren't in it anymore
+	var managed []adminUser
+	if err := db.Where("ldap_dn <> '' AND disabled = ?", false).Find(&managed).Error; err != nil {
+		return details, err
+	}
+	for _, u := range managed {
+		if seen[u.ID] {
+			continue
+		}
+		report.Disabled++
+		details = append(details, fmt.Sprintf("disable %s: not in directory anymore", u.Email))
+		if report.DryRun {
+			continue
+		}
+		if err := setActiveBy(db, &u, false, true); err != nil {
+			return details, err
+		}
+	}
+	return details, nil
+}
+
+// roles replaces the roles granted by the directory groups among the current
+// roles of a user, in order. The roles set by Invite, the CLI or SCIM are
+// kept.
+func (s *ldapSync) roles(current string, granted []string) string {
+	owned := map[string]bool{}
+	for _, role := range s.groupRoles {
+		owned[role] = true
+	}
+	var roles []string
+	for _, role := range strings.Split(current, ",") {
+		if role != "" && !owned[role] {
+			roles = append(roles, role)
+		}
+	}
+	return sortedRoles(strings.Join(append(roles, granted...), ","))
+}
+
+// sortedRoles sorts and deduplicates a comma separated list of roles, so that
+// the lists compare regardless of who wrote them last
+func sortedRoles(roles string) string {
+	seen := map[string]bool{}
+	var list []string
+	for _, role := range strings.Split(roles, ",") {
+		if role != "" && !seen[role] {
+			seen[role] = true
+			list = append(list, role)
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// diffUser lists the attributes which differ between the user and the
+// directory
+func diffUser(u, wanted adminUser) []string {
+	var changes []string
+	if u.Email != wanted.Email {
+		changes = append(changes, fmt.Sprintf("email %s -> %s", u.Email, wanted.Email))
+	}
+	if u.Brid != wanted.Brid {
+		changes = append(changes, fmt.Sprintf("uid %s -> %s", u.Brid, wanted.Brid))
+	}
+	if u.FirstName != wanted.FirstName || u.LastName != wanted.LastName {
+		changes = append(changes, fmt.Sprintf("name %s %s -> %s %s", u.FirstName, u.LastName, wanted.FirstName, wanted.LastName))
+	}
+	if sortedRoles(u.Roles) != sortedRoles(wanted.Roles) {
+		changes = append(changes, fmt.Sprintf("roles [%s] -> [%s]", u.Roles, wanted.Roles))
+	}
+	if u.LDAPDN != wanted.LDAPDN {
+		changes = append(changes, fmt.Sprintf("dn %s -> %s", u.LDAPDN, wanted.LDAPDN))
+	}
+	return changes
+}
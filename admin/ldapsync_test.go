@@ -0,0 +1,198 @@
+package admin
+
+import (
+	"context"
+	"testing"
+
+	"qor-admin-3/admin/ldap"
+)
+
+// syncDirectory serves fixed users and groups to the sync
+type syncDirectory struct {
+	ldap.Client
+	users  []ldap.Entry
+	groups []ldap.Group
+}
+
+func (d syncDirectory) Users() ([]ldap.Entry, error)  { return d.users, nil }
+func (d syncDirectory) Groups() ([]ldap.Group, error) { return d.groups, nil }
+
+const (
+	adaDN = "uid=ada,dc=example,dc=com"
+	bobDN = "uid=bob,dc=example,dc=com"
+)
+
+func TestLDAPSyncRun(t *testing.T) {
+	ada := ldap.Entry{DN: adaDN, UID: "ada", Mail: "ada@example.com", GivenName: "Ada", Surname: "Lovelace"}
+	admins := ldap.Group{Name: "admins", Members: []string{adaDN}}
+	tests := []struct {
+		name   string
+		before []adminUser
+		users  []ldap.Entry
+		groups []ldap.Group
+		want   []adminUser
+		report SyncReport
+	}{
+		{
+			name:   "create",
+			users:  []ldap.Entry{ada},
+			groups: []ldap.Group{admins},
+			want:   []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", Roles: "admin", LDAPDN: adaDN}},
+			report: SyncReport{Created: 1},
+		},
+		{
+			name:   "unchanged",
+			before: []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", Roles: "admin", LDAPDN: adaDN}},
+			users:  []ldap.Entry{ada},
+			groups: []ldap.Group{admins},
+			want:   []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", Roles: "admin", LDAPDN: adaDN}},
+			report: SyncReport{Unchanged: 1},
+		},
+		{
+			name:   "rename by uid",
+			before: []adminUser{{Email: "ada.old@example.com", Brid: "ada", FirstName: "Ada", LastName: "Byron", LDAPDN: adaDN}},
+			users:  []ldap.Entry{ada},
+			want:   []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", LDAPDN: adaDN}},
+			report: SyncReport{Updated: 1},
+		},
+		{
+			name:   "link by email",
+			before: []adminUser{{Email: "ada@example.com", Brid: "ada-old", Roles: "support"}},
+			users:  []ldap.Entry{ada},
+			want:   []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", Roles: "support", LDAPDN: adaDN}},
+			report: SyncReport{Updated: 1},
+		},
+		{
+			name:   "email of a local account",
+			before: []adminUser{{Email: "ada@example.com", Brid: "ada-local", Password: []byte("hash")}},
+			users:  []ldap.Entry{ada},
+			want:   []adminUser{{Email: "ada@example.com", Brid: "ada-local", Password: []byte("hash")}},
+			report: SyncReport{Conflicts: 1},
+		},
+		{
+			name:   "disabled in directory",
+			before: []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", LDAPDN: adaDN}},
+			users:  []ldap.Entry{{DN: adaDN, UID: "ada", Mail: "ada@example.com", GivenName: "Ada", Surname: "Lovelace", Disabled: true}},
+			want:   []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", LDAPDN: adaDN, Disabled: true, DisabledBySync: true}},
+			report: SyncReport{Disabled: 1},
+		},
+		{
+			name:   "gone from directory",
+			before: []adminUser{{Email: "bob@example.com", Brid: "bob", LDAPDN: bobDN}},
+			want:   []adminUser{{Email: "bob@example.com", Brid: "bob", LDAPDN: bobDN, Disabled: true, DisabledBySync: true}},
+			report: SyncReport{Disabled: 1},
+		},
+		{
+			name:   "enabled again",
+			before: []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", LDAPDN: adaDN, Disabled: true, DisabledBySync: true}},
+			users:  []ldap.Entry{ada},
+			want:   []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", LDAPDN: adaDN}},
+			report: SyncReport{Enabled: 1},
+		},
+		{
+			name:   "disabled by an admin",
+			before: []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", LDAPDN: adaDN, Disabled: true}},
+			users:  []ldap.Entry{ada},
+			want:   []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", LDAPDN: adaDN, Disabled: true}},
+			report: SyncReport{Unchanged: 1},
+		},
+		{
+			name:   "role mapping keeps the other roles",
+			before: []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", Roles: "support,editor", LDAPDN: adaDN}},
+			users:  []ldap.Entry{ada},
+			groups: []ldap.Group{admins},
+			want:   []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", Roles: "admin,support", LDAPDN: adaDN}},
+			report: SyncReport{Updated: 1},
+		},
+		{
+			name:   "role order",
+			before: []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", Roles: "support,admin", LDAPDN: adaDN}},
+			users:  []ldap.Entry{ada},
+			groups: []ldap.Group{admins},
+			want:   []adminUser{{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", Roles: "support,admin", LDAPDN: adaDN}},
+			report: SyncReport{Unchanged: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			for _, u := range tt.before {
+				if err := db.Create(&u).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := &ldapSync{
+				client:     syncDirectory{users: tt.users, groups: tt.groups},
+				groupRoles: map[string]string{"admins": "admin", "editors": "editor"},
+			}
+			var report SyncReport
+			if _, err := s.run(context.Background(), db, &report); err != nil {
+				t.Fatal(err)
+			}
+			if report != tt.report {
+				t.Errorf("got report %+v, want %+v", report, tt.report)
+			}
+
+			var got []adminUser
+			if err := db.Order("id").Find(&got).Error; err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d users, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				u := got[i]
+				if u.Email != want.Email || u.Brid != want.Brid || u.FirstName != want.FirstName || u.LastName != want.LastName ||
+					u.Roles != want.Roles || u.LDAPDN != want.LDAPDN || u.Disabled != want.Disabled || u.DisabledBySync != want.DisabledBySync {
+					t.Errorf("got %+v, want %+v", u, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLDAPSyncDryRun(t *testing.T) {
+	db := testDB(t)
+	s := &ldapSync{client: syncDirectory{users: []ldap.Entry{{DN: adaDN, UID: "ada", Mail: "ada@example.com"}}}}
+	report := SyncReport{DryRun: true}
+	details, err := s.run(context.Background(), db, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	db.Model(&adminUser{}).Count(&count)
+	if report.Created != 1 || len(details) != 1 || count != 0 {
+		t.Errorf("got report %+v, details %q and %d users, want 1 reported creation only", report, details, count)
+	}
+}
+
+func TestDiffUser(t *testing.T) {
+	u := adminUser{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace", Roles: "b,a", LDAPDN: adaDN}
+	tests := []struct {
+		name   string
+		wanted adminUser
+		want   []string
+	}{
+		{"same", u, nil},
+		{"roles in another order", adminUser{Email: u.Email, Brid: u.Brid, FirstName: u.FirstName, LastName: u.LastName, Roles: "a,b", LDAPDN: adaDN}, nil},
+		{"email", adminUser{Email: "ada@example.org", Brid: u.Brid, FirstName: u.FirstName, LastName: u.LastName, Roles: u.Roles, LDAPDN: adaDN},
+			[]string{"email ada@example.com -> ada@example.org"}},
+		{"name and roles", adminUser{Email: u.Email, Brid: u.Brid, FirstName: "Augusta", LastName: u.LastName, Roles: "a", LDAPDN: adaDN},
+			[]string{"name Ada Lovelace -> Augusta Lovelace", "roles [b,a] -> [a]"}},
+		{"dn", adminUser{Email: u.Email, Brid: u.Brid, FirstName: u.FirstName, LastName: u.LastName, Roles: u.Roles, LDAPDN: bobDN},
+			[]string{"dn " + adaDN + " -> " + bobDN}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffUser(u, tt.wanted)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package admin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"qor-admin-3/admin/logging"
+	"qor-admin-3/admin/mail"
+)
+
+// Token purposes, a token issued for one purpose can't be used for another
+const (
+	tokenInvite = "invite"
+	tokenReset  = "reset"
+)
+
+var errInvalidToken = errors.New("this link is invalid or has expired")
+
+// LocalAccountsConfig enables the local (non-LDAP) admin accounts and their
+// self-service flows
+type LocalAccountsConfig struct {
+	BaseURL   string      // public URL of the application used in the emails, ex. "https://admin.example.com"
+	From      string      // sender address of the emails
+	Sender    mail.Sender // delivers the emails
+	InviteTTL time.Duration
+	ResetTTL  time.Duration
+}
+
+type localConfig struct {
+	LocalAccountsConfig
+	secret []byte
+}
+
+// adminToken is a single-use token sent by email
+type adminToken struct {
+	ID          uint `gorm:"primary_key"`
+	AdminUserID uint `gorm:"index;not null"`
+	Purpose     string
+	Hash        string `gorm:"not null;unique"`
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+	CreatedAt   time.Time
+}
+
+// UseLocalAccounts enables local accounts. Users with a password set are
+// authenticated against it instead of LDAP.
+func (a *Admin) UseLocalAccounts(cfg LocalAccountsConfig) error {
+	if cfg.Sender == nil || cfg.BaseURL == "" || cfg.From == "" {
+		return errors.New("[CONFIG] Local accounts require a mail sender, a base URL and a from address")
+	}
+	if cfg.InviteTTL == 0 {
+		cfg.InviteTTL = 72 * time.Hour
+	}
+	if cfg.ResetTTL == 0 {
+		cfg.ResetTTL = time.Hour
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	a.auth.local = &localConfig{LocalAccountsConfig: cfg, secret: a.auth.secret}
+	return a.db.AutoMigrate(&adminPassword{}, &adminToken{}).Error
+}
+
+// Invite creates a local account without password and emails the user a link
+// to choose one
+func (a *Admin) Invite(email, brid string, roles ...string) error {
+	if a.auth.local == nil {
+		return errors.New("local accounts are not enabled")
+	}
+	user := adminUser{Email: email, Brid: brid, Roles: strings.Join(roles, ",")}
+	if err := a.db.Where(adminUser{Email: email}).Attrs(user).FirstOrCreate(&user).Error; err != nil {
+		return err
+	}
+	for _, role := range roles {
+		registerRole(role)
+	}
+	return a.auth.sendToken(user, tokenInvite)
+}
+
+// sign returns the signature of a token nonce for a purpose
+func (l localConfig) sign(purpose, nonce string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	fmt.Fprintf(mac, "%s|%s", purpose, nonce)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func hashToken(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendToken issues a new token for the user, invalidating the unused ones
+// for the same purpose, and emails the matching link
+func (a *auth) sendToken(u adminUser, purpose string) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	ttl, path, subject := a.local.ResetTTL, a.paths.reset, "Reset your admin password"
+	if purpose == tokenInvite {
+		ttl, path, subject = a.local.InviteTTL, a.paths.invite, "You have been invited to the admin"
+	}
+	// only the last link sent works
+	tx := a.db.Begin()
+	if err := tx.Model(&adminToken{}).Where("admin_user_id = ? AND purpose = ? AND used_at IS NULL", u.ID, purpose).
+		Update("used_at", time.Now()).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Create(&adminToken{
+		AdminUserID: u.ID,
+		Purpose:     purpose,
+		Hash:        hashToken(nonce),
+		ExpiresAt:   time.Now().Add(ttl),
+	}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s%s?token=%s.%s", a.local.BaseURL, path, nonce, a.local.sign(purpose, nonce))
+	return a.local.Sender.Send(mail.Message{
+		From:    a.local.From,
+		To:      u.Email,
+		Subject: subject,
+		Body: fmt.Sprintf("Hello %s,\n\nFollow this link to choose your password:\n%s\n\nThe link expires in %s and can only be used once.\n",
+			u.DisplayName(), link, ttl),
+	})
+}
+
+// findToken checks the signature and expiry of a token and returns it
+func (a *auth) findToken(token, purpose string) (adminToken, error) {
+	var t adminToken
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(a.local.sign(purpose, parts[0]))) {
+		return t, errInvalidToken
+	}
+	err := a.db.Where("hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hashToken(parts[0]), purpose, time.Now()).First(&t).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return t, errInvalidToken
+	}
+	return t, err
+}
+
+// useToken marks the token as used, it fails if it was used concurrently
+func (a *auth) useToken(t adminToken) error {
+	res := a.db.Model(&adminToken{}).Where("id = ? AND used_at IS NULL", t.ID).Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// localLogin authenticates a user against the password of its local account
+func (a *auth) localLogin(c *gin.Context, u adminUser, password string) {
+	session := sessions.Default(c)
+	if u.Disabled || !u.checkPassword(password) {
+		a.metrics.login("local", "failure")
+		session.Delete(a.session.key)
+		if err := session.Save(); err != nil {
+			logging.FromContext(c.Request.Context()).WithError(err).Warn("Couldn't save session")
+		}
+		c.Redirect(http.StatusSeeOther, a.paths.login)
+		return
+	}
+	a.metrics.login("local", "success")
+	now := time.Now()
+	a.db.Model(&u).Update("last_login", &now)
+	session.Set(a.session.key, u.Email)
+	session.Set(sessionLoginAt, now.UnixNano())
+	session.Set(sessionUserID, u.ID)
+	if err := session.Save(); err != nil {
+		logging.FromContext(c.Request.Context()).WithError(err).Warn("Couldn't save session")
+		c.Redirect(http.StatusSeeOther, a.paths.login)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, a.paths.admin)
+}
+
+// GetForgot returns the forgot password page
+func (a *auth) GetForgot(c *gin.Context) {
+	a.render(c, http.StatusOK, "forgot.html", gin.H{"Login": a.paths.login})
+}
+
+// PostForgot sends a reset link to the email if it matches a local account.
+// The answer is the same either way to not disclose which accounts exist, and
+// the link is sent in the background so that the response time doesn't
+// either.
+func (a *auth) PostForgot(c *gin.Context) {
+	email := c.PostForm("email")
+	var user adminUser
+	if email != "" {
+		if err := a.db.Where(adminUser{Email: email}).First(&user).Error; err == nil && len(user.Password) > 0 {
+			log := logging.FromContext(c.Request.Context())
+			go func() {
+				if err := a.sendToken(user, tokenReset); err != nil {
+					log.WithError(err).Warn("Couldn't send the password reset email")
+				}
+			}()
+		}
+	}
+	a.render(c, http.StatusOK, "forgot.html", gin.H{
+		"Login":   a.paths.login,
+		"Message": "If an account matches this email, a reset link has been sent to it.",
+	})
+}
+
+// GetPassword returns the page to choose a password for an invitation or a
+// reset link
+func (a *auth) GetPassword(purpose string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if _, err := a.findToken(token, purpose); err != nil {
+			a.render(c, http.StatusOK, "password.html", gin.H{"Login": a.paths.login, "Error": errInvalidToken.Error()})
+			return
+		}
+		a.render(c, http.StatusOK, "password.html", gin.H{"Login": a.paths.login, "Token": token, "Invite": purpose == tokenInvite})
+	}
+}
+
+// PostPassword sets the password of the user holding a valid token
+func (a *auth) PostPassword(purpose string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.PostForm("token")
+		page := gin.H{"Login": a.paths.login, "Token": token, "Invite": purpose == tokenInvite}
+		password := c.PostForm("password")
+		if password != c.PostForm("confirm") {
+			page["Error"] = "passwords don't match"
+			a.render(c, http.StatusOK, "password.html", page)
+			return
+		}
+
+		t, err := a.findToken(token, purpose)
+		if err != nil {
+			a.render(c, http.StatusOK, "password.html", gin.H{"Login": a.paths.login, "Error": errInvalidToken.Error()})
+			return
+		}
+		var user adminUser
+		if err = a.db.First(&user, t.AdminUserID).Error; err != nil {
+			logging.FromContext(c.Request.Context()).WithError(err).Warn("Couldn't find the user of a token")
+			a.render(c, http.StatusOK, "password.html", gin.H{"Login": a.paths.login, "Error": errInvalidToken.Error()})
+			return
+		}
+		if err = validatePassword(a.db, user, password); err != nil {
+			page["Error"] = err.Error()
+			a.render(c, http.StatusOK, "password.html", page)
+			return
+		}
+		if err = a.useToken(t); err != nil {
+			a.render(c, http.StatusOK, "password.html", gin.H{"Login": a.paths.login, "Error": errInvalidToken.Error()})
+			return
+		}
+		if err = setPassword(a.db, &user, password); err != nil {
+			logging.FromContext(c.Request.Context()).WithError(err).Warn("Couldn't save the new password")
+			a.render(c, http.StatusOK, "password.html", gin.H{"Login": a.paths.login, "Error": "the password couldn't be saved, please ask for a new link"})
+			return
+		}
+		c.Redirect(http.StatusSeeOther, a.paths.login)
+	}
+}
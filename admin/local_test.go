@@ -0,0 +1,215 @@
+package admin
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"qor-admin-3/admin/mail"
+)
+
+var tokenLink = regexp.MustCompile(`token=(\S+)`)
+
+// testLocal returns the auth of an admin with local accounts sending the
+// emails to memory
+func testLocal(db *gorm.DB) (*auth, *mail.MemorySender) {
+	a := testAuth(db)
+	sender := &mail.MemorySender{}
+	a.local = &localConfig{
+		LocalAccountsConfig: LocalAccountsConfig{BaseURL: "https://admin.example.com", From: "admin@example.com", Sender: sender, InviteTTL: time.Hour, ResetTTL: time.Hour},
+		secret:              a.secret,
+	}
+	a.paths = pathConfig{login: "/login", admin: "/admin", forgot: "/forgot", reset: "/reset", invite: "/invite"}
+	a.templates = template.Must(template.New("forgot.html").Parse("{{.Message}}"))
+	template.Must(a.templates.New("password.html").Parse("{{.Error}}"))
+	return a, sender
+}
+
+// lastToken returns the token of the last link sent
+func lastToken(t *testing.T, sender *mail.MemorySender) string {
+	t.Helper()
+	messages := sender.Messages()
+	if len(messages) == 0 {
+		t.Fatal("no email sent")
+	}
+	m := tokenLink.FindStringSubmatch(messages[len(messages)-1].Body)
+	if m == nil {
+		t.Fatalf("no link in %q", messages[len(messages)-1].Body)
+	}
+	return m[1]
+}
+
+func TestTokens(t *testing.T) {
+	db, u := passwordDB(t)
+	a, sender := testLocal(db)
+	if err := a.sendToken(u, tokenReset); err != nil {
+		t.Fatal(err)
+	}
+	token := lastToken(t, sender)
+	if m := sender.Messages()[0]; m.To != u.Email || m.From != "admin@example.com" || !strings.Contains(m.Body, "https://admin.example.com/reset?token=") {
+		t.Errorf("sent %+v", m)
+	}
+
+	nonce := strings.SplitN(token, ".", 2)[0]
+	for name, tampered := range map[string]string{
+		"other purpose":     token,
+		"bad signature":     nonce + "." + a.local.sign(tokenReset, "other"),
+		"missing signature": nonce,
+	} {
+		purpose := tokenReset
+		if name == "other purpose" {
+			purpose = tokenInvite
+		}
+		if _, err := a.findToken(tampered, purpose); err != errInvalidToken {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	found, err := a.findToken(token, tokenReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.AdminUserID != u.ID {
+		t.Errorf("the token belongs to user %d", found.AdminUserID)
+	}
+	if err := a.useToken(found); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.useToken(found); err != errInvalidToken {
+		t.Errorf("second use: got %v", err)
+	}
+	if _, err := a.findToken(token, tokenReset); err != errInvalidToken {
+		t.Errorf("used token: got %v", err)
+	}
+
+	if err := a.sendToken(u, tokenReset); err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&adminToken{}).Where("used_at IS NULL").Update("expires_at", time.Now().Add(-time.Minute))
+	if _, err := a.findToken(lastToken(t, sender), tokenReset); err != errInvalidToken {
+		t.Errorf("expired token: got %v", err)
+	}
+}
+
+func TestOnlyLastLinkWorks(t *testing.T) {
+	db, u := passwordDB(t)
+	a, sender := testLocal(db)
+	if err := a.sendToken(u, tokenInvite); err != nil {
+		t.Fatal(err)
+	}
+	invite := lastToken(t, sender)
+	if err := a.sendToken(u, tokenReset); err != nil {
+		t.Fatal(err)
+	}
+	first := lastToken(t, sender)
+	if err := a.sendToken(u, tokenReset); err != nil {
+		t.Fatal(err)
+	}
+	last := lastToken(t, sender)
+
+	if _, err := a.findToken(first, tokenReset); err != errInvalidToken {
+		t.Errorf("earlier reset link: got %v", err)
+	}
+	if _, err := a.findToken(last, tokenReset); err != nil {
+		t.Errorf("last reset link: got %v", err)
+	}
+	// the links of another purpose are left alone
+	if _, err := a.findToken(invite, tokenInvite); err != nil {
+		t.Errorf("invite link: got %v", err)
+	}
+}
+
+// localServer serves the forgot and reset pages
+func localServer(a *auth) http.Handler {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(sessions.Sessions(a.session.name, a.session.store))
+	e.POST("/forgot", a.PostForgot)
+	e.POST("/reset", a.PostPassword(tokenReset))
+	return e
+}
+
+func post(h http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPostForgot(t *testing.T) {
+	db, u := passwordDB(t)
+	if err := setPassword(db, &u, "Correct-Horse-1"); err != nil {
+		t.Fatal(err)
+	}
+	a, sender := testLocal(db)
+	h := localServer(a)
+
+	unknown := post(h, "/forgot", url.Values{"email": {"bob@example.com"}})
+	known := post(h, "/forgot", url.Values{"email": {u.Email}})
+	if unknown.Code != known.Code || unknown.Body.String() != known.Body.String() {
+		t.Errorf("the answers differ: %d %q and %d %q", unknown.Code, unknown.Body, known.Code, known.Body)
+	}
+
+	// the link is sent in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sender.Messages()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if messages := sender.Messages(); len(messages) != 1 || messages[0].To != u.Email {
+		t.Errorf("sent %+v", messages)
+	}
+}
+
+func TestPostPasswordReset(t *testing.T) {
+	db, u := passwordDB(t)
+	if err := setPassword(db, &u, "Correct-Horse-1"); err != nil {
+		t.Fatal(err)
+	}
+	a, sender := testLocal(db)
+	h := localServer(a)
+	session := login(t, a, u, time.Now())
+	if err := a.sendToken(u, tokenReset); err != nil {
+		t.Fatal(err)
+	}
+	token := lastToken(t, sender)
+
+	tests := []struct {
+		name     string
+		password string
+		confirm  string
+		status   int
+		body     string
+	}{
+		{"mismatch", "Correct-Horse-2", "Correct-Horse-3", http.StatusOK, "passwords don&#39;t match"},
+		{"weak", "short", "short", http.StatusOK, "at least 12 characters"},
+		{"reused", "Correct-Horse-1", "Correct-Horse-1", http.StatusOK, template.HTMLEscapeString(errPasswordReused.Error())},
+		{"changed", "Correct-Horse-2", "Correct-Horse-2", http.StatusSeeOther, ""},
+		{"link used", "Correct-Horse-3", "Correct-Horse-3", http.StatusOK, "this link is invalid or has expired"},
+	}
+	for _, tt := range tests {
+		rec := post(h, "/reset", url.Values{"token": {token}, "password": {tt.password}, "confirm": {tt.confirm}})
+		if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, rec.Code, rec.Body, tt.status, tt.body)
+		}
+	}
+
+	if err := db.First(&u, u.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !u.checkPassword("Correct-Horse-2") {
+		t.Error("the password wasn't changed")
+	}
+	if loggedIn(a, session) {
+		t.Error("the session opened before the reset still works")
+	}
+}
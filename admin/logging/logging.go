@@ -0,0 +1,99 @@
+// Package logging configures the structured logs of the admin and carries the
+// logger of a request, with its request ID, through the context.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDField is the name of the request ID in the log entries
+const RequestIDField = "request_id"
+
+// redacted replaces the values of the sensitive fields
+const redacted = "[REDACTED]"
+
+// sensitive lists the parts of a field name whose value must never be logged
+var sensitive = []string{"password", "secret", "token", "cookie", "authorization", "session"}
+
+type loggerKey struct{}
+
+// Configure sets the level and format ("json" or "text") of the logger and
+// installs the redaction of the secrets and personal data
+func Configure(logger *logrus.Logger, level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json", "":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		return fmt.Errorf("unknown log format %q, use json or text", format)
+	}
+	logger.SetLevel(lvl)
+	logger.AddHook(redactHook{})
+	return nil
+}
+
+// NewContext returns a copy of ctx carrying the logger entry
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, entry)
+}
+
+// FromContext returns the logger entry of the request, or the standard logger
+// outside of a request
+func FromContext(ctx context.Context) *logrus.Entry {
+	if ctx != nil {
+		if entry, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+			return entry
+		}
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// RequestID returns the ID of the request carried by ctx, if any
+func RequestID(ctx context.Context) string {
+	id, _ := FromContext(ctx).Data[RequestIDField].(string)
+	return id
+}
+
+// Email masks an email address, only its first letter and domain are kept,
+// ex. "j***@example.com"
+func Email(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		if email == "" {
+			return ""
+		}
+		return email[:1] + "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// redactHook removes the secrets and masks the emails of the entries
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	for key, value := range entry.Data {
+		name := strings.ToLower(key)
+		for _, s := range sensitive {
+			if strings.Contains(name, s) {
+				entry.Data[key] = redacted
+			}
+		}
+		if s, ok := value.(string); ok && (name == "email" || name == "user") {
+			entry.Data[key] = Email(s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"qor-admin-3/admin/ldap"
+	"qor-admin-3/admin/logging"
+	"qor-admin-3/admin/tracing"
+)
+
+// requestIDHeader carries the request ID, it's reused when set by a proxy
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID restricts the forwarded IDs so they can't forge log lines
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestLog is the middleware giving an ID to every request. The logger of
+// the request, see logging.FromContext, includes it and the request is logged
+// once served.
+func RequestLog(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = uuid.New().String()
+	}
+	c.Header(requestIDHeader, id)
+	entry := logrus.WithField(logging.RequestIDField, id)
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsValid() {
+		entry = entry.WithField("trace_id", sc.TraceID().String())
+	}
+	c.Request = c.Request.WithContext(logging.NewContext(c.Request.Context(), entry))
+
+	start := time.Now()
+	c.Next()
+
+	entry = entry.WithFields(logrus.Fields{
+		"method":   c.Request.Method,
+		"path":     c.Request.URL.Path,
+		"status":   c.Writer.Status(),
+		"duration": time.Since(start).String(),
+		"remote":   c.ClientIP(),
+	})
+	if len(c.Errors) > 0 {
+		entry = entry.WithField("errors", c.Errors.String())
+	}
+	// the probes would flood the logs
+	if strings.HasSuffix(c.FullPath(), "/healthz") || strings.HasSuffix(c.FullPath(), "/readyz") {
+		entry.Debug("Request served")
+		return
+	}
+	entry.Info("Request served")
+}
+
+// SetLogLevel changes the level of the logs while running, ex. "debug"
+func (a *Admin) SetLogLevel(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+	logrus.WithField("level", lvl.String()).Info("Log level changed")
+	return nil
+}
+
+// logLevel reads (GET) or changes (PUT level=debug) the log level. It's
+// restricted like the metrics.
+func (a *Admin) logLevel(c *gin.Context) {
+	if c.Request.Method == http.MethodPut {
+		if err := a.SetLogLevel(c.PostForm("level")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"level": logrus.GetLevel().String()})
+}
+
+// ldapLog logs and traces the operations of an LDAP client with the request
+// they belong to
+type ldapLog struct {
+	ldap.Client
+	ctx context.Context
+}
+
+// withLog returns the client logging its operations with the logger of ctx
+// and tracing them as children of its span
+func withLog(ctx context.Context, client ldap.Client) ldap.Client {
+	return ldapLog{Client: client, ctx: ctx}
+}
+
+// start begins an operation, the returned function ends it
+func (l ldapLog) start(operation string) func(err error) {
+	start := time.Now()
+	_, span := tracing.Start(l.ctx, "ldap "+operation, attribute.String("ldap.operation", operation))
+	return func(err error) {
+		entry := logging.FromContext(l.ctx).WithField("ldap_operation", operation).WithField("duration", time.Since(start).String())
+		// a rejected password is not an LDAP failure
+		if err == ldap.ErrInvalidCredentials {
+			span.SetAttributes(attribute.Bool("ldap.invalid_credentials", true))
+			err = nil
+		}
+		tracing.End(span, err)
+		if err != nil {
+			entry.WithError(err).Warn("LDAP operation failed")
+			return
+		}
+		entry.Debug("LDAP operation")
+	}
+}
+
+func (l ldapLog) Auth(username, password string) error {
+	end := l.start("auth")
+	err := l.Client.Auth(username, password)
+	end(err)
+	return err
+}
+
+func (l ldapLog) Lookup(username string) (ldap.Entry, error) {
+	end := l.start("lookup")
+	e, err := l.Client.Lookup(username)
+	end(err)
+	return e, err
+}
+
+func (l ldapLog) LookupDN(dn string) (ldap.Entry, error) {
+	end := l.start("lookup_dn")
+	e, err := l.Client.LookupDN(dn)
+	end(err)
+	return e, err
+}
+
+func (l ldapLog) Users() ([]ldap.Entry, error) {
+	end := l.start("users")
+	users, err := l.Client.Users()
+	end(err)
+	return users, err
+}
+
+func (l ldapLog) Groups() ([]ldap.Group, error) {
+	end := l.start("groups")
+	groups, err := l.Client.Groups()
+	end(err)
+	return groups, err
+}
+
+func (l ldapLog) Ping() error {
+	end := l.start("ping")
+	err := l.Client.Ping()
+	end(err)
+	return err
+}
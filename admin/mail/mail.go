@@ -0,0 +1,109 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender interface delivers emails
+type Sender interface {
+	Send(m Message) error
+}
+
+// bytes renders the message in the RFC 5322 format
+func (m Message) bytes() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", header(m.From))
+	fmt.Fprintf(&buf, "To: %s\r\n", header(m.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", header(m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	buf.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+// header strips the line breaks from a header value, so that it can't add
+// other headers
+func header(v string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(v)
+}
+
+// SMTPConfig to provide an SMTP sender.
+// Username and Password are optional.
+type SMTPConfig struct {
+	Host     string // the smtp host and port, ex. "smtp.example.com:587"
+	Username string
+	Password string
+}
+
+// SMTPSender sends the messages through an SMTP relay
+type SMTPSender struct {
+	SMTPConfig
+}
+
+// NewSMTPSender returns a Sender using the provided SMTP relay
+func NewSMTPSender(config SMTPConfig) (*SMTPSender, error) {
+	if config.Host == "" {
+		return nil, errors.New("[CONFIG] The SMTP host is required")
+	}
+	return &SMTPSender{config}, nil
+}
+
+// Send implementation for the Sender interface
+func (s *SMTPSender) Send(m Message) error {
+	var a smtp.Auth
+	if s.Username != "" {
+		host := strings.Split(s.Host, ":")[0]
+		a = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Host, a, m.From, []string{m.To}, m.bytes())
+}
+
+// FileSender writes every message as an .eml file in a directory, it is
+// meant for local development
+type FileSender struct {
+	Dir string
+}
+
+// Send implementation for the Sender interface
+func (s FileSender) Send(m Message) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(m.To))
+	return ioutil.WriteFile(filepath.Join(s.Dir, name), m.bytes(), 0600)
+}
+
+// MemorySender keeps the messages in memory, it is meant for tests
+type MemorySender struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send implementation for the Sender interface
+func (s *MemorySender) Send(m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, m)
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far
+func (s *MemorySender) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
@@ -0,0 +1,251 @@
+package admin
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+
+	"qor-admin-3/admin/ldap"
+)
+
+// activeWindow is how long a user counts as active after their last request
+const activeWindow = 30 * time.Minute
+
+// metrics holds the Prometheus collectors of the admin, registered on a
+// private registry so the host application's one is left untouched
+type metrics struct {
+	registry *prometheus.Registry
+	trusted  []*net.IPNet
+	role     string
+
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	logins           *prometheus.CounterVec
+	ldapDuration     *prometheus.HistogramVec
+	ldapErrors       *prometheus.CounterVec
+	dynamoDuration   *prometheus.HistogramVec
+	dynamoErrors     *prometheus.CounterVec
+	dynamoCapacity   *prometheus.CounterVec
+	resourcesByParam map[string]bool
+
+	mu   sync.Mutex
+	seen map[string]time.Time // last request of each signed in user
+}
+
+func newMetrics(cfg MetricsConfig) *metrics {
+	m := metrics{
+		registry: prometheus.NewRegistry(),
+		role:     cfg.Role,
+		seen:     map[string]time.Time{},
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qor_admin_http_requests_total",
+			Help: "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "qor_admin_http_request_duration_seconds",
+			Help:    "HTTP request latency by route and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qor_admin_login_attempts_total",
+			Help: "Login form attempts by backend (ldap, local) and outcome (success, failure, error).",
+		}, []string{"backend", "outcome"}),
+		ldapDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "qor_admin_ldap_operation_duration_seconds",
+			Help:    "LDAP operation latency.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		ldapErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qor_admin_ldap_errors_total",
+			Help: "Failed LDAP operations.",
+		}, []string{"operation"}),
+		dynamoDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "qor_admin_dynamodb_call_duration_seconds",
+			Help:    "DynamoDB call latency by qor handler and operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"handler", "operation"}),
+		dynamoErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qor_admin_dynamodb_errors_total",
+			Help: "Failed DynamoDB calls by qor handler and operation.",
+		}, []string{"handler", "operation"}),
+		dynamoCapacity: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qor_admin_dynamodb_consumed_capacity_total",
+			Help: "Capacity units consumed by qor handler and operation.",
+		}, []string{"handler", "operation"}),
+	}
+	for _, cidr := range cfg.TrustedCIDRs {
+		// validated with the configuration
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			m.trusted = append(m.trusted, network)
+		}
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.requests, m.requestDuration, m.logins,
+		m.ldapDuration, m.ldapErrors,
+		m.dynamoDuration, m.dynamoErrors, m.dynamoCapacity,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "qor_admin_active_sessions",
+			Help: "Signed in users who made a request in the last 30 minutes.",
+		}, m.activeSessions),
+	)
+	return &m
+}
+
+// Instrument is the middleware counting the requests and their latency. The
+// admin routes are labelled with the resource, ex. "/admin/customers".
+func (m *metrics) Instrument(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	} else if strings.HasSuffix(route, "/admin/*resources") {
+		param := strings.SplitN(strings.TrimPrefix(c.Param("resources"), "/"), "/", 2)[0]
+		if m.resourcesByParam[param] {
+			route = strings.TrimSuffix(route, "*resources") + param
+		}
+	}
+	m.requests.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+	m.requestDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+}
+
+// login counts a login form attempt
+func (m *metrics) login(backend, outcome string) {
+	m.logins.WithLabelValues(backend, outcome).Inc()
+}
+
+// active records a request of a signed in user
+func (m *metrics) active(email string) {
+	m.mu.Lock()
+	m.seen[email] = time.Now()
+	m.mu.Unlock()
+}
+
+// activeSessions counts the users seen recently and forgets the others
+func (m *metrics) activeSessions() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for email, at := range m.seen {
+		if time.Since(at) > activeWindow {
+			delete(m.seen, email)
+		}
+	}
+	return float64(len(m.seen))
+}
+
+// observeDynamoDB is the dynamo.Config observer
+func (m *metrics) observeDynamoDB(handler, operation string, d time.Duration, capacity float64, err error) {
+	m.dynamoDuration.WithLabelValues(handler, operation).Observe(d.Seconds())
+	m.dynamoCapacity.WithLabelValues(handler, operation).Add(capacity)
+	if err != nil {
+		m.dynamoErrors.WithLabelValues(handler, operation).Inc()
+	}
+}
+
+// Handler serves the metrics, see Restrict
+func (m *metrics) Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// Restrict is the middleware granting the access to the metrics and the log
+// level to the trusted networks and to the users holding the metrics role
+func (m *metrics) Restrict(a *auth) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !m.allowed(a, c.Request) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
+
+func (m *metrics) allowed(a *auth, req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range m.trusted {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	if m.role == "" {
+		return false
+	}
+	user, ok := a.GetCurrentUser(&admin.Context{Context: &qor.Context{Request: req}}).(adminUser)
+	return ok && user.hasRole(m.role)
+}
+
+// ldap instruments an LDAP client
+func (m *metrics) ldap(client ldap.Client) ldap.Client {
+	return ldapMetrics{Client: client, m: m}
+}
+
+// ldapMetrics times the operations of an LDAP client
+type ldapMetrics struct {
+	ldap.Client
+	m *metrics
+}
+
+func (l ldapMetrics) observe(operation string, start time.Time, err error) {
+	l.m.ldapDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	// a rejected password is not an LDAP failure
+	if err != nil && err != ldap.ErrInvalidCredentials {
+		l.m.ldapErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func (l ldapMetrics) Auth(username, password string) error {
+	start := time.Now()
+	err := l.Client.Auth(username, password)
+	l.observe("auth", start, err)
+	return err
+}
+
+func (l ldapMetrics) Lookup(username string) (ldap.Entry, error) {
+	start := time.Now()
+	e, err := l.Client.Lookup(username)
+	l.observe("lookup", start, err)
+	return e, err
+}
+
+func (l ldapMetrics) LookupDN(dn string) (ldap.Entry, error) {
+	start := time.Now()
+	e, err := l.Client.LookupDN(dn)
+	l.observe("lookup_dn", start, err)
+	return e, err
+}
+
+func (l ldapMetrics) Users() ([]ldap.Entry, error) {
+	start := time.Now()
+	users, err := l.Client.Users()
+	l.observe("users", start, err)
+	return users, err
+}
+
+func (l ldapMetrics) Groups() ([]ldap.Group, error) {
+	start := time.Now()
+	groups, err := l.Client.Groups()
+	l.observe("groups", start, err)
+	return groups, err
+}
+
+func (l ldapMetrics) Ping() error {
+	start := time.Now()
+	err := l.Client.Ping()
+	l.observe("ping", start, err)
+	return err
+}
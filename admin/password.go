@@ -0,0 +1,106 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password rules for local admin accounts
+const (
+	passwordMinLength = 12
+	passwordClasses   = 3 // out of lower, upper, digit and symbol
+	passwordHistory   = 5 // number of previous passwords which can't be reused
+)
+
+var errPasswordReused = fmt.Errorf("password was used recently, the last %d passwords can't be reused", passwordHistory)
+
+// adminPassword keeps the hashes of the previous passwords of a user
+type adminPassword struct {
+	ID          uint `gorm:"primary_key"`
+	AdminUserID uint `gorm:"index;not null"`
+	Hash        []byte
+	CreatedAt   time.Time
+}
+
+// checkPasswordStrength validates a new password against the password rules
+func checkPasswordStrength(password string, u adminUser) error {
+	if len([]rune(password)) < passwordMinLength {
+		return fmt.Errorf("password must be at least %d characters long", passwordMinLength)
+	}
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower+upper+digit+symbol < passwordClasses {
+		return fmt.Errorf("password must contain %d of: lowercase, uppercase, digits and symbols", passwordClasses)
+	}
+	lp := strings.ToLower(password)
+	for _, s := range []string{u.Email, strings.Split(u.Email, "@")[0], u.Brid, u.FirstName, u.LastName} {
+		if len(s) > 2 && strings.Contains(lp, strings.ToLower(s)) {
+			return errors.New("password must not contain your name or email")
+		}
+	}
+	return nil
+}
+
+// validatePassword checks a new password against the rules and the history
+// of the user
+func validatePassword(db *gorm.DB, u adminUser, password string) error {
+	if err := checkPasswordStrength(password, u); err != nil {
+		return err
+	}
+
+	var history []adminPassword
+	if err := db.Where(adminPassword{AdminUserID: u.ID}).Order("id desc").Limit(passwordHistory).Find(&history).Error; err != nil {
+		return err
+	}
+	for _, h := range history {
+		if bcrypt.CompareHashAndPassword(h.Hash, []byte(password)) == nil {
+			return errPasswordReused
+		}
+	}
+	return nil
+}
+
+// setPassword validates then stores the new password of the user and revokes
+// the sessions opened with the previous one
+func setPassword(db *gorm.DB, u *adminUser, password string) error {
+	if err := validatePassword(db, *u, password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tx := db.Begin()
+	if err := tx.Model(u).Updates(map[string]interface{}{"password": hash, "sessions_revoked_at": &now}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Create(&adminPassword{AdminUserID: u.ID, Hash: hash}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// checkPassword compares the password with the one of a local account
+func (u adminUser) checkPassword(password string) bool {
+	return len(u.Password) > 0 && bcrypt.CompareHashAndPassword(u.Password, []byte(password)) == nil
+}
@@ -0,0 +1,101 @@
+package admin
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// passwordDB returns a database with a user ready for a local account
+func passwordDB(t *testing.T) (*gorm.DB, adminUser) {
+	t.Helper()
+	db := testDB(t)
+	if err := db.AutoMigrate(&adminPassword{}, &adminToken{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	u := adminUser{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace"}
+	if err := db.Create(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+	return db, u
+}
+
+func TestCheckPasswordStrength(t *testing.T) {
+	u := adminUser{Email: "ada@example.com", Brid: "ada", FirstName: "Ada", LastName: "Lovelace"}
+	tests := []struct {
+		password string
+		err      string
+	}{
+		{"Short1!", "at least 12 characters"},
+		{"onlylowercaseletters", "must contain 3 of"},
+		{"lowercaseand1234", "must contain 3 of"},
+		{"Lovelace-Rules-42", "must not contain your name or email"},
+		{"my ada@example.com Key", "must not contain your name or email"},
+		{"Correct-Horse-9", ""},
+		{"ÉLÉPHANT-rose-7", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			err := checkPasswordStrength(tt.password, u)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	db, u := passwordDB(t)
+	password := func(i int) string { return fmt.Sprintf("Correct-Horse-%d", i) }
+	for i := 0; i <= passwordHistory; i++ {
+		if err := setPassword(db, &u, password(i)); err != nil {
+			t.Fatalf("password %d: %v", i, err)
+		}
+		// every password of the history is refused
+		if err := validatePassword(db, u, password(i)); err != errPasswordReused {
+			t.Errorf("password %d reused: got %v", i, err)
+		}
+	}
+	if err := validatePassword(db, u, password(1)); err != errPasswordReused {
+		t.Errorf("a password of the history: got %v", err)
+	}
+	// the oldest one left the history
+	if err := validatePassword(db, u, password(0)); err != nil {
+		t.Errorf("a password older than the history: got %v", err)
+	}
+
+	if err := db.First(&u, u.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !u.checkPassword(password(passwordHistory)) || u.checkPassword(password(0)) {
+		t.Error("the last password isn't the one checked")
+	}
+}
+
+func TestSetPasswordRevokesSessions(t *testing.T) {
+	db, u := passwordDB(t)
+	a := testAuth(db)
+	before := login(t, a, u, time.Now())
+	if !loggedIn(a, before) {
+		t.Fatal("the session is rejected before the password change")
+	}
+	if err := setPassword(db, &u, "Correct-Horse-1"); err != nil {
+		t.Fatal(err)
+	}
+	if loggedIn(a, before) {
+		t.Error("the session opened before the password change still works")
+	}
+	// right after the change, in the same second
+	if after := login(t, a, u, time.Now()); !loggedIn(a, after) {
+		t.Error("the session opened after the password change is rejected")
+	}
+}
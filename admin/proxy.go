@@ -0,0 +1,189 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"qor-admin-3/admin/logging"
+)
+
+// ProxyAuthConfig configures the trusted reverse-proxy authentication mode.
+// In this mode the admin trusts the identity headers set by an authenticating
+// proxy instead of showing the login form.
+type ProxyAuthConfig struct {
+	UserHeader   string            // defaults to "X-Forwarded-User"
+	GroupsHeader string            // defaults to "X-Forwarded-Groups"
+	EmailDomain  string            // appended to the user header when it isn't an email, ex. "example.com"
+	TrustedCIDRs []string          // only requests coming from these networks are accepted
+	GroupRoles   map[string]string // maps a proxy group to an admin role
+	LoginURL     string            // optional proxy sign-in page, used when no identity is found
+	LogoutURL    string            // optional proxy sign-out page
+}
+
+type proxyConfig struct {
+	userHeader   string
+	groupsHeader string
+	emailDomain  string
+	trusted      []*net.IPNet
+	groupRoles   map[string]string
+	loginURL     string
+	logoutURL    string
+}
+
+// lastLoginInterval is how often the last login of the users authenticated
+// on every request is recorded
+const lastLoginInterval = time.Minute
+
+var (
+	errUntrustedProxy = errors.New("request doesn't come from a trusted proxy")
+	errNoProxyUser    = errors.New("no user provided by the proxy")
+)
+
+// newProxyConfig validates the configuration and parses the trusted networks
+func newProxyConfig(cfg ProxyAuthConfig) (*proxyConfig, error) {
+	if len(cfg.TrustedCIDRs) == 0 {
+		return nil, errors.New("[CONFIG] Proxy authentication requires at least one trusted CIDR")
+	}
+	p := proxyConfig{
+		userHeader:   cfg.UserHeader,
+		groupsHeader: cfg.GroupsHeader,
+		emailDomain:  cfg.EmailDomain,
+		groupRoles:   cfg.GroupRoles,
+		loginURL:     cfg.LoginURL,
+		logoutURL:    cfg.LogoutURL,
+	}
+	if p.userHeader == "" {
+		p.userHeader = "X-Forwarded-User"
+	}
+	if p.groupsHeader == "" {
+		p.groupsHeader = "X-Forwarded-Groups"
+	}
+	for _, cidr := range cfg.TrustedCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("[CONFIG] Invalid trusted CIDR %q: %v", cidr, err)
+		}
+		p.trusted = append(p.trusted, network)
+	}
+	return &p, nil
+}
+
+// isTrusted checks the address of the peer connection, not any forwarded
+// header, since those can be set by anyone
+func (p proxyConfig) isTrusted(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// roles maps the groups header to the configured admin roles
+func (p proxyConfig) roles(req *http.Request) []string {
+	var roles []string
+	seen := map[string]bool{}
+	for _, group := range strings.Split(req.Header.Get(p.groupsHeader), ",") {
+		role, ok := p.groupRoles[strings.TrimSpace(group)]
+		if !ok || seen[role] {
+			continue
+		}
+		seen[role] = true
+		roles = append(roles, role)
+	}
+	return roles
+}
+
+// proxyUser returns the user identified by the proxy headers, provisioning
+// or updating the matching adminUser record
+func (a *auth) proxyUser(req *http.Request) (*adminUser, error) {
+	if u, ok := req.Context().Value(currentUserKey{}).(*adminUser); ok {
+		return u, nil
+	}
+	if !a.proxy.isTrusted(req) {
+		return nil, errUntrustedProxy
+	}
+	name := strings.TrimSpace(req.Header.Get(a.proxy.userHeader))
+	if name == "" {
+		return nil, errNoProxyUser
+	}
+	email := name
+	if !strings.Contains(email, "@") && a.proxy.emailDomain != "" {
+		email = fmt.Sprintf("%s@%s", name, a.proxy.emailDomain)
+	}
+
+	now := time.Now()
+	roles := strings.Join(a.proxy.roles(req), ",")
+	var user adminUser
+	err := a.db.Where("email = ?", email).First(&user).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		user = adminUser{Email: email, Brid: name, Roles: roles, LastLogin: &now}
+		if err := a.db.Create(&user).Error; err != nil {
+			return nil, err
+		}
+		return &user, nil
+	case err != nil:
+		return nil, err
+	case user.Disabled:
+		return nil, errUserDisabled
+	}
+	// every request carries the identity, the row is only written when the
+	// roles changed or the last login is stale
+	if user.Roles != roles || user.LastLogin == nil || now.Sub(*user.LastLogin) > lastLoginInterval {
+		user.Roles, user.LastLogin = roles, &now
+		if err := a.db.Model(&user).Updates(map[string]interface{}{"roles": roles, "last_login": &now}).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// ProxyAuth is a middleware which authenticates the request using the proxy
+// headers. Requests without a valid identity are rejected since there is no
+// login page to redirect to.
+func (a *auth) ProxyAuth(c *gin.Context) {
+	user, err := a.proxyUser(c.Request)
+	if err != nil {
+		logging.FromContext(c.Request.Context()).WithError(err).WithField("remote", c.Request.RemoteAddr).Warn("Proxy authentication failed")
+		if a.proxy.loginURL != "" && err == errNoProxyUser {
+			c.Redirect(http.StatusSeeOther, a.proxy.loginURL)
+			c.Abort()
+			return
+		}
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), currentUserKey{}, user))
+	c.Next()
+}
+
+// UseProxyAuth switches the admin to the trusted reverse-proxy authentication
+// mode. It must be called before Bind.
+func (a *Admin) UseProxyAuth(cfg ProxyAuthConfig) error {
+	p, err := newProxyConfig(cfg)
+	if err != nil {
+		return err
+	}
+	a.auth.proxy = p
+	for _, role := range cfg.GroupRoles {
+		registerRole(role)
+	}
+	return nil
+}
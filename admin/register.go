@@ -0,0 +1,246 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/sirupsen/logrus"
+
+	"qor-admin-3/admin/dynamo"
+	"qor-admin-3/admin/logging"
+)
+
+// trashPurgeInterval is the time between two purges of the expired trash
+const trashPurgeInterval = time.Hour
+
+// Backend configures the storage of a registered resource
+type Backend interface {
+	Configure(a *Admin, res *admin.Resource) error
+}
+
+// BackendFunc allows a function to be used as a Backend
+type BackendFunc func(a *Admin, res *admin.Resource) error
+
+// Configure implementation for the Backend interface
+func (f BackendFunc) Configure(a *Admin, res *admin.Resource) error {
+	return f(a, res)
+}
+
+// preparer is implemented by the backends which check the model before the
+// resource is added to the admin, so that a failed registration doesn't leave
+// it in the menu. prepare returns the backend configuring the resource.
+type preparer interface {
+	prepare(a *Admin, value interface{}) (Backend, error)
+}
+
+// Gorm stores the resource with the gorm connection of the admin, the table
+// is migrated on registration
+var Gorm Backend = gormBackend{}
+
+type gormBackend struct{}
+
+func (gormBackend) prepare(a *Admin, value interface{}) (Backend, error) {
+	if err := a.db.AutoMigrate(value).Error; err != nil {
+		return nil, err
+	}
+	return BackendFunc(func(a *Admin, res *admin.Resource) error {
+		a.migrations = append(a.migrations, func(context.Context) error {
+			return a.db.AutoMigrate(res.Value).Error
+		})
+		return nil
+	}), nil
+}
+
+// Configure implementation for the Backend interface
+func (b gormBackend) Configure(a *Admin, res *admin.Resource) error {
+	configure, err := b.prepare(a, res.Value)
+	if err != nil {
+		return err
+	}
+	return configure.Configure(a, res)
+}
+
+// DynamoDB stores the resource in DynamoDB, in the table named after the
+// plural of the model, ex. "Customers". See DynamoDBTable.
+var DynamoDB = DynamoDBTable("")
+
+// DynamoDBTable stores the resource in the named DynamoDB table. The key and
+// attributes are derived from the struct tags of the model, see dynamo.Table.
+// The readiness probe checks the table and Migrate creates it. With soft
+// deletes, StartJobs purges the trash of the items older than the retention.
+func DynamoDBTable(name string) Backend {
+	return dynamoBackend(name)
+}
+
+// dynamoBackend is the name of the DynamoDB table, empty for the default one
+type dynamoBackend string
+
+func (name dynamoBackend) prepare(a *Admin, value interface{}) (Backend, error) {
+	table, err := dynamo.NewTable(value, string(name))
+	if err != nil {
+		return nil, err
+	}
+	db, err := a.dynamoDB()
+	if err != nil {
+		return nil, err
+	}
+	return BackendFunc(func(a *Admin, res *admin.Resource) error {
+		a.health.add("dynamodb:"+table.Name, db.Check(table))
+		a.migrations = append(a.migrations, func(ctx context.Context) error {
+			return db.Provision(ctx, table)
+		})
+		db.Configure(res, table)
+		if retention := a.config.DynamoDB.TrashRetention; retention > 0 && table.SoftDeletes() {
+			a.jobs = append(a.jobs, func() { a.purgeTrash(db, table, retention) })
+		}
+		return nil
+	}), nil
+}
+
+// Configure implementation for the Backend interface
+func (name dynamoBackend) Configure(a *Admin, res *admin.Resource) error {
+	configure, err := name.prepare(a, res.Value)
+	if err != nil {
+		return err
+	}
+	return configure.Configure(a, res)
+}
+
+// purgeTrash removes the items of the table trashed for longer than the
+// retention, every trashPurgeInterval
+func (a *Admin) purgeTrash(db *dynamo.DB, table *dynamo.Table, retention time.Duration) {
+	log := logrus.WithFields(logrus.Fields{"job": "dynamodb_purge", "dynamodb_table": table.Name})
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.stop:
+			return
+		}
+		n, err := db.PurgeBefore(logging.NewContext(context.Background(), log), table, time.Now().Add(-retention))
+		if err != nil {
+			log.WithError(err).Warn("Trash purge failed")
+		}
+		if n > 0 {
+			log.WithField("purged", n).Info("Purged the expired trash")
+		}
+	}
+}
+
+// dynamoDB returns the DynamoDB client shared by the resources
+func (a *Admin) dynamoDB() (*dynamo.DB, error) {
+	if a.dynamo == nil {
+		dc := a.config.DynamoDB.Models()
+		dc.Observe = a.metrics.observeDynamoDB
+		db, err := dynamo.New(dc)
+		if err != nil {
+			return nil, err
+		}
+		a.dynamo = db
+	}
+	return a.dynamo, nil
+}
+
+// Migrate creates or updates the tables of the admin, including the optional
+// features, and provisions the storage of the registered resources
+func (a *Admin) Migrate(ctx context.Context) error {
+	if err := a.db.AutoMigrate(&adminUser{}, &adminPassword{}, &adminToken{}, &adminGroup{}, &SyncReport{}).Error; err != nil {
+		return err
+	}
+	for _, migrate := range a.migrations {
+		if err := migrate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handlers is a Backend made of custom handlers. The handlers left nil keep
+// the default gorm behaviour.
+type Handlers struct {
+	FindOne  func(result interface{}, metaValues *resource.MetaValues, context *qor.Context) error
+	FindMany func(result interface{}, context *qor.Context) error
+	Save     func(result interface{}, context *qor.Context) error
+	Delete   func(result interface{}, context *qor.Context) error
+}
+
+// Configure implementation for the Backend interface
+func (h Handlers) Configure(a *Admin, res *admin.Resource) error {
+	if h.FindOne != nil {
+		res.FindOneHandler = h.FindOne
+	}
+	if h.FindMany != nil {
+		res.FindManyHandler = h.FindMany
+	}
+	if h.Save != nil {
+		res.SaveHandler = h.Save
+	}
+	if h.Delete != nil {
+		res.DeleteHandler = h.Delete
+	}
+	return nil
+}
+
+// ResourceOptions configures how a registered resource is shown in the admin.
+// All fields are optional.
+type ResourceOptions struct {
+	Name        string            // defaults to the model name
+	Menu        []string          // parent menus, ex. []string{"Sales"}
+	Priority    int               // position in the menu
+	Permission  *roles.Permission // defaults to everything allowed
+	IndexAttrs  []interface{}     // columns of the listing
+	ShowAttrs   []interface{}
+	EditAttrs   []interface{}
+	NewAttrs    []interface{}
+	SearchAttrs []string
+	Configure   func(res *admin.Resource) // for any other setting
+}
+
+// Register adds a model to the admin, stored by the provided backend. It must
+// be called before Bind. When the model doesn't suit Gorm or DynamoDB, the
+// error is returned before the resource is added.
+func (a *Admin) Register(value interface{}, backend Backend, opts ResourceOptions) (*admin.Resource, error) {
+	if value == nil || backend == nil {
+		return nil, errors.New("a model and a backend are required")
+	}
+	if p, ok := backend.(preparer); ok {
+		var err error
+		if backend, err = p.prepare(a, value); err != nil {
+			return nil, err
+		}
+	}
+	res := a.adm.AddResource(value, &admin.Config{
+		Name:       opts.Name,
+		Menu:       opts.Menu,
+		Priority:   opts.Priority,
+		Permission: opts.Permission,
+	})
+	if err := backend.Configure(a, res); err != nil {
+		return nil, err
+	}
+	if len(opts.IndexAttrs) > 0 {
+		res.IndexAttrs(opts.IndexAttrs...)
+	}
+	if len(opts.ShowAttrs) > 0 {
+		res.ShowAttrs(opts.ShowAttrs...)
+	}
+	if len(opts.EditAttrs) > 0 {
+		res.EditAttrs(opts.EditAttrs...)
+	}
+	if len(opts.NewAttrs) > 0 {
+		res.NewAttrs(opts.NewAttrs...)
+	}
+	if len(opts.SearchAttrs) > 0 {
+		res.SearchAttrs(opts.SearchAttrs...)
+	}
+	if opts.Configure != nil {
+		opts.Configure(res)
+	}
+	return res, nil
+}
@@ -0,0 +1,852 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"qor-admin-3/admin/logging"
+)
+
+// SCIM 2.0 schemas used by the provisioning endpoints
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// SCIMConfig enables the SCIM 2.0 provisioning endpoints
+type SCIMConfig struct {
+	Token string // bearer token expected from the identity provider
+}
+
+type scimConfig struct {
+	token []byte
+	path  string
+}
+
+// adminGroup is a provisioned group, its members are granted its role
+type adminGroup struct {
+	ID          uint   `gorm:"primary_key"`
+	DisplayName string `gorm:"not null;unique"`
+	ExternalID  string
+	Role        string
+	Members     []adminUser `gorm:"many2many:admin_group_members"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// UseSCIM enables the SCIM 2.0 /Users and /Groups endpoints
+func (a *Admin) UseSCIM(cfg SCIMConfig) error {
+	if cfg.Token == "" {
+		return errors.New("[CONFIG] SCIM requires a bearer token")
+	}
+	a.scim = &scimConfig{token: []byte(cfg.Token), path: a.prefix + "/scim/v2"}
+	if err := a.db.AutoMigrate(&adminGroup{}).Error; err != nil {
+		return err
+	}
+	var groups []adminGroup
+	if err := a.db.Find(&groups).Error; err != nil {
+		return err
+	}
+	for _, g := range groups {
+		registerRole(g.Role)
+	}
+	return nil
+}
+
+type scimName struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+type scimUser struct {
+	Schemas    []string    `json:"schemas"`
+	ID         string      `json:"id,omitempty"`
+	ExternalID string      `json:"externalId,omitempty"`
+	UserName   string      `json:"userName"`
+	Name       scimName    `json:"name"`
+	Emails     []scimValue `json:"emails,omitempty"`
+	Active     *bool       `json:"active,omitempty"`
+	Groups     []scimValue `json:"groups,omitempty"`
+	Meta       *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []scimValue `json:"members"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimPatch struct {
+	Schemas    []string `json:"schemas"`
+	Operations []struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value interface{} `json:"value"`
+	} `json:"Operations"`
+}
+
+type scimList struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+// scimError is an error returned with a specific SCIM status
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e scimError) Error() string { return e.detail }
+
+var scimFilter = regexp.MustCompile(`^(\w+)\s+eq\s+"([^"]*)"$`)
+
+// Bearer is the middleware checking the SCIM bearer token
+func (s *scimConfig) Bearer(c *gin.Context) {
+	h := c.GetHeader("Authorization")
+	token := strings.TrimPrefix(h, "Bearer ")
+	if token == h || subtle.ConstantTimeCompare([]byte(token), s.token) != 1 {
+		scimAbort(c, scimError{status: http.StatusUnauthorized, detail: "invalid bearer token"})
+		return
+	}
+	c.Next()
+}
+
+// scimAbort writes err as a SCIM error response
+func scimAbort(c *gin.Context, err error) {
+	e, ok := err.(scimError)
+	if !ok {
+		if gorm.IsRecordNotFoundError(err) {
+			e = scimError{status: http.StatusNotFound, detail: "resource not found"}
+		} else {
+			logging.FromContext(c.Request.Context()).WithError(err).Warn("SCIM request failed")
+			e = scimError{status: http.StatusInternalServerError, detail: "internal error"}
+		}
+	}
+	body := gin.H{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(e.status), "detail": e.detail}
+	if e.scimType != "" {
+		body["scimType"] = e.scimType
+	}
+	c.Header("Content-Type", "application/scim+json")
+	c.AbortWithStatusJSON(e.status, body)
+}
+
+func scimJSON(c *gin.Context, status int, v interface{}) {
+	c.Header("Content-Type", "application/scim+json")
+	c.JSON(status, v)
+}
+
+// pagination reads the SCIM startIndex (1-based) and count parameters
+func scimPagination(c *gin.Context) (int, int) {
+	start, err := strconv.Atoi(c.Query("startIndex"))
+	if err != nil || start < 1 {
+		start = 1
+	}
+	count, err := strconv.Atoi(c.Query("count"))
+	if err != nil || count < 0 || count > 200 {
+		count = 200
+	}
+	return start, count
+}
+
+// scimWhere applies a simple `attribute eq "value"` filter to the query
+func scimWhere(db *gorm.DB, filter string, columns map[string]string) (*gorm.DB, error) {
+	if filter == "" {
+		return db, nil
+	}
+	m := scimFilter.FindStringSubmatch(strings.TrimSpace(filter))
+	if m == nil {
+		return nil, scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "only `attribute eq \"value\"` filters are supported"}
+	}
+	column, ok := columns[m[1]]
+	if !ok {
+		return nil, scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: fmt.Sprintf("unsupported filter attribute %s", m[1])}
+	}
+	return db.Where(column+" = ?", m[2]), nil
+}
+
+func (s *scimConfig) toUser(u adminUser, groups []adminGroup) scimUser {
+	active := !u.Disabled
+	su := scimUser{
+		Schemas:    []string{scimUserSchema},
+		ID:         strconv.FormatUint(uint64(u.ID), 10),
+		ExternalID: u.Brid,
+		UserName:   u.Email,
+		Name:       scimName{GivenName: u.FirstName, FamilyName: u.LastName},
+		Emails:     []scimValue{{Value: u.Email, Primary: true}},
+		Active:     &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      u.CreatedAt,
+			LastModified: u.UpdatedAt,
+			Location:     fmt.Sprintf("%s/Users/%d", s.path, u.ID),
+		},
+	}
+	for _, g := range groups {
+		su.Groups = append(su.Groups, scimValue{Value: strconv.FormatUint(uint64(g.ID), 10), Display: g.DisplayName})
+	}
+	return su
+}
+
+func (s *scimConfig) toGroup(g adminGroup) scimGroup {
+	sg := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          strconv.FormatUint(uint64(g.ID), 10),
+		ExternalID:  g.ExternalID,
+		DisplayName: g.DisplayName,
+		Members:     []scimValue{},
+		Meta: &scimMeta{
+			ResourceType: "Group",
+			Created:      g.CreatedAt,
+			LastModified: g.UpdatedAt,
+			Location:     fmt.Sprintf("%s/Groups/%d", s.path, g.ID),
+		},
+	}
+	for _, m := range g.Members {
+		sg.Members = append(sg.Members, scimValue{Value: strconv.FormatUint(uint64(m.ID), 10), Display: m.DisplayName()})
+	}
+	return sg
+}
+
+// scimID parses the :id parameter. gorm would splice an id which isn't a
+// number into the SQL, so it's an unknown resource.
+func scimID(c *gin.Context) (uint64, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, scimError{status: http.StatusNotFound, detail: "resource not found"}
+	}
+	return id, nil
+}
+
+// findUser loads the user of the :id parameter
+func findUser(db *gorm.DB, c *gin.Context) (adminUser, error) {
+	var u adminUser
+	id, err := scimID(c)
+	if err != nil {
+		return u, err
+	}
+	return u, db.First(&u, id).Error
+}
+
+// findGroup loads the group of the :id parameter with its members
+func findGroup(db *gorm.DB, c *gin.Context) (adminGroup, error) {
+	var g adminGroup
+	id, err := scimID(c)
+	if err != nil {
+		return g, err
+	}
+	return g, db.Preload("Members").First(&g, id).Error
+}
+
+// userGroups returns the groups the user is a member of
+func userGroups(db *gorm.DB, u adminUser) ([]adminGroup, error) {
+	var groups []adminGroup
+	err := db.Joins("JOIN admin_group_members ON admin_group_members.admin_group_id = admin_groups.id").
+		Where("admin_group_members.admin_user_id = ?", u.ID).Find(&groups).Error
+	return groups, err
+}
+
+// refreshRoles recomputes the roles the groups grant to the users. Only the
+// roles of the groups, including the removed ones, are owned by SCIM: the
+// roles set by Invite, the CLI or the directory sync are kept.
+func refreshRoles(db *gorm.DB, removed []string, users ...adminUser) error {
+	owned := map[string]bool{}
+	var groupRoles []string
+	if err := db.Model(&adminGroup{}).Pluck("role", &groupRoles).Error; err != nil {
+		return err
+	}
+	for _, role := range append(groupRoles, removed...) {
+		owned[role] = true
+	}
+	for _, u := range users {
+		if err := db.First(&u, u.ID).Error; err != nil {
+			return err
+		}
+		groups, err := userGroups(db, u)
+		if err != nil {
+			return err
+		}
+		var roles []string
+		for _, role := range strings.Split(u.Roles, ",") {
+			if role != "" && !owned[role] {
+				roles = append(roles, role)
+			}
+		}
+		granted := map[string]bool{}
+		for _, g := range groups {
+			if g.Role != "" && !granted[g.Role] {
+				granted[g.Role] = true
+				roles = append(roles, g.Role)
+			}
+		}
+		if err := db.Model(&u).Update("roles", strings.Join(roles, ",")).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setActive enables or disables a user, disabling it revokes its sessions
+func setActive(db *gorm.DB, u *adminUser, active bool) error {
+	return setActiveBy(db, u, active, false)
+}
+
+// setActiveBy is setActive recording if the directory sync disabled the
+// user, the sync only enables those again
+func setActiveBy(db *gorm.DB, u *adminUser, active, bySync bool) error {
+	if !active && !u.Disabled {
+		now := time.Now()
+		u.SessionsRevokedAt = &now
+	}
+	u.Disabled = !active
+	u.DisabledBySync = u.Disabled && bySync
+	return db.Model(u).Updates(map[string]interface{}{
+		"disabled":            u.Disabled,
+		"disabled_by_sync":    u.DisabledBySync,
+		"sessions_revoked_at": u.SessionsRevokedAt,
+	}).Error
+}
+
+// ListUsers is the SCIM handler for GET /Users
+func (s *scimConfig) ListUsers(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, err := scimWhere(db.Model(&adminUser{}), c.Query("filter"), map[string]string{"userName": "email", "externalId": "brid"})
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		start, count := scimPagination(c)
+		var total int
+		var users []adminUser
+		if err := q.Count(&total).Order("id").Offset(start - 1).Limit(count).Find(&users).Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		resources := []scimUser{}
+		for _, u := range users {
+			groups, err := userGroups(db, u)
+			if err != nil {
+				scimAbort(c, err)
+				return
+			}
+			resources = append(resources, s.toUser(u, groups))
+		}
+		scimJSON(c, http.StatusOK, scimList{Schemas: []string{scimListSchema}, TotalResults: total, StartIndex: start, ItemsPerPage: len(resources), Resources: resources})
+	}
+}
+
+// GetUser is the SCIM handler for GET /Users/:id
+func (s *scimConfig) GetUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, err := findUser(db, c)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		groups, err := userGroups(db, u)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		scimJSON(c, http.StatusOK, s.toUser(u, groups))
+	}
+}
+
+// applyUser copies the SCIM attributes to the admin user
+func applyUser(u *adminUser, su scimUser) error {
+	if su.UserName == "" {
+		return scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "userName is required"}
+	}
+	u.Email = su.UserName
+	u.Brid = su.ExternalID
+	if u.Brid == "" {
+		u.Brid = su.UserName
+	}
+	u.FirstName = su.Name.GivenName
+	u.LastName = su.Name.FamilyName
+	return nil
+}
+
+// userConflict returns the SCIM uniqueness error when another user has the
+// userName or externalId of u
+func userConflict(db *gorm.DB, u adminUser) error {
+	err := db.Where("(email = ? OR brid = ?) AND id <> ?", u.Email, u.Brid, u.ID).First(&adminUser{}).Error
+	switch {
+	case err == nil:
+		return scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "a user with this userName or externalId already exists"}
+	case gorm.IsRecordNotFoundError(err):
+		return nil
+	}
+	return err
+}
+
+// CreateUser is the SCIM handler for POST /Users
+func (s *scimConfig) CreateUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var su scimUser
+		if err := c.ShouldBindJSON(&su); err != nil {
+			scimAbort(c, scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()})
+			return
+		}
+		var u adminUser
+		if err := applyUser(&u, su); err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if err := userConflict(db, u); err != nil {
+			scimAbort(c, err)
+			return
+		}
+		u.Disabled = su.Active != nil && !*su.Active
+		if err := db.Create(&u).Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		scimJSON(c, http.StatusCreated, s.toUser(u, nil))
+	}
+}
+
+// ReplaceUser is the SCIM handler for PUT /Users/:id
+func (s *scimConfig) ReplaceUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, err := findUser(db, c)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		var su scimUser
+		if err := c.ShouldBindJSON(&su); err != nil {
+			scimAbort(c, scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()})
+			return
+		}
+		if err := applyUser(&u, su); err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if err := userConflict(db, u); err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if err := db.Save(&u).Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if su.Active != nil {
+			if err := setActive(db, &u, *su.Active); err != nil {
+				scimAbort(c, err)
+				return
+			}
+		}
+		s.GetUser(db)(c)
+	}
+}
+
+// PatchUser is the SCIM handler for PATCH /Users/:id
+func (s *scimConfig) PatchUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, err := findUser(db, c)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		var patch scimPatch
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			scimAbort(c, scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()})
+			return
+		}
+		for _, op := range patch.Operations {
+			if !strings.EqualFold(op.Op, "replace") && !strings.EqualFold(op.Op, "add") {
+				scimAbort(c, scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: fmt.Sprintf("unsupported operation %s", op.Op)})
+				return
+			}
+			values := map[string]interface{}{op.Path: op.Value}
+			if op.Path == "" {
+				v, ok := op.Value.(map[string]interface{})
+				if !ok {
+					scimAbort(c, scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "value must be an object when path is omitted"})
+					return
+				}
+				values = v
+			}
+			for path, value := range values {
+				if err := patchUser(db, &u, path, value); err != nil {
+					scimAbort(c, err)
+					return
+				}
+			}
+		}
+		if err := userConflict(db, u); err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if err := db.Save(&u).Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		s.GetUser(db)(c)
+	}
+}
+
+// patchUser applies a single attribute change to the user
+func patchUser(db *gorm.DB, u *adminUser, path string, value interface{}) error {
+	if path == "active" {
+		active, ok := value.(bool)
+		if !ok {
+			// some providers send booleans as strings
+			active = fmt.Sprint(value) == "True" || fmt.Sprint(value) == "true"
+		}
+		return setActive(db, u, active)
+	}
+	str, ok := value.(string)
+	if !ok {
+		return scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: fmt.Sprintf("invalid value for %s", path)}
+	}
+	switch path {
+	case "userName":
+		u.Email = str
+	case "externalId":
+		u.Brid = str
+	case "name.givenName":
+		u.FirstName = str
+	case "name.familyName":
+		u.LastName = str
+	default:
+		return scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: fmt.Sprintf("unsupported path %s", path)}
+	}
+	return nil
+}
+
+// DeleteUser is the SCIM handler for DELETE /Users/:id. The sessions of the
+// user end with its row, see GetCurrentUser.
+func (s *scimConfig) DeleteUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, err := findUser(db, c)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		tx := db.Begin()
+		if err := tx.Exec("DELETE FROM admin_group_members WHERE admin_user_id = ?", u.ID).Error; err != nil {
+			tx.Rollback()
+			scimAbort(c, err)
+			return
+		}
+		if err := tx.Delete(&u).Error; err != nil {
+			tx.Rollback()
+			scimAbort(c, err)
+			return
+		}
+		if err := tx.Commit().Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// ListGroups is the SCIM handler for GET /Groups
+func (s *scimConfig) ListGroups(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, err := scimWhere(db.Model(&adminGroup{}), c.Query("filter"), map[string]string{"displayName": "display_name", "externalId": "external_id"})
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		start, count := scimPagination(c)
+		var total int
+		var groups []adminGroup
+		if err := q.Count(&total).Preload("Members").Order("id").Offset(start - 1).Limit(count).Find(&groups).Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		resources := []scimGroup{}
+		for _, g := range groups {
+			resources = append(resources, s.toGroup(g))
+		}
+		scimJSON(c, http.StatusOK, scimList{Schemas: []string{scimListSchema}, TotalResults: total, StartIndex: start, ItemsPerPage: len(resources), Resources: resources})
+	}
+}
+
+// GetGroup is the SCIM handler for GET /Groups/:id
+func (s *scimConfig) GetGroup(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		g, err := findGroup(db, c)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		scimJSON(c, http.StatusOK, s.toGroup(g))
+	}
+}
+
+// members loads the users referenced by SCIM member values
+func members(db *gorm.DB, values []scimValue) ([]adminUser, error) {
+	users := []adminUser{}
+	if len(values) == 0 {
+		return users, nil
+	}
+	// the providers may list a member twice
+	var ids []string
+	seen := map[string]bool{}
+	for _, v := range values {
+		if !seen[v.Value] {
+			seen[v.Value] = true
+			ids = append(ids, v.Value)
+		}
+	}
+	if err := db.Where("id IN (?)", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	if len(users) != len(ids) {
+		return nil, scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "unknown member"}
+	}
+	return users, nil
+}
+
+// setMembers replaces the members of a group and refreshes the roles of the
+// users whose membership changed, in a transaction
+func setMembers(db *gorm.DB, g *adminGroup, users []adminUser) error {
+	previous := g.Members
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(g).Association("Members").Replace(users).Error; err != nil {
+			return err
+		}
+		return refreshRoles(tx, nil, append(previous, users...)...)
+	})
+	if err != nil {
+		return err
+	}
+	g.Members = users
+	return nil
+}
+
+// CreateGroup is the SCIM handler for POST /Groups
+func (s *scimConfig) CreateGroup(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var sg scimGroup
+		if err := c.ShouldBindJSON(&sg); err != nil || sg.DisplayName == "" {
+			scimAbort(c, scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "displayName is required"})
+			return
+		}
+		if !db.Where(adminGroup{DisplayName: sg.DisplayName}).First(&adminGroup{}).RecordNotFound() {
+			scimAbort(c, scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "a group with this displayName already exists"})
+			return
+		}
+		users, err := members(db, sg.Members)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		g := adminGroup{DisplayName: sg.DisplayName, ExternalID: sg.ExternalID, Role: sg.DisplayName}
+		if err := db.Create(&g).Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if !registerRole(g.Role) {
+			logging.FromContext(c.Request.Context()).WithField("role", g.Role).Warn("The role of the new SCIM group is granted after a restart")
+		}
+		if err := setMembers(db, &g, users); err != nil {
+			scimAbort(c, err)
+			return
+		}
+		scimJSON(c, http.StatusCreated, s.toGroup(g))
+	}
+}
+
+// ReplaceGroup is the SCIM handler for PUT /Groups/:id
+func (s *scimConfig) ReplaceGroup(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		g, err := findGroup(db, c)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		var sg scimGroup
+		if err := c.ShouldBindJSON(&sg); err != nil || sg.DisplayName == "" {
+			scimAbort(c, scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "displayName is required"})
+			return
+		}
+		users, err := members(db, sg.Members)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if err := db.Model(&g).Updates(map[string]interface{}{"display_name": sg.DisplayName, "external_id": sg.ExternalID}).Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if err := setMembers(db, &g, users); err != nil {
+			scimAbort(c, err)
+			return
+		}
+		scimJSON(c, http.StatusOK, s.toGroup(g))
+	}
+}
+
+var scimMemberPath = regexp.MustCompile(`^members\[value eq "([^"]*)"\]$`)
+
+// PatchGroup is the SCIM handler for PATCH /Groups/:id
+func (s *scimConfig) PatchGroup(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		g, err := findGroup(db, c)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		var patch scimPatch
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			scimAbort(c, scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()})
+			return
+		}
+
+		current := map[string]adminUser{}
+		for _, m := range g.Members {
+			current[strconv.FormatUint(uint64(m.ID), 10)] = m
+		}
+		for _, op := range patch.Operations {
+			switch {
+			case op.Path == "displayName":
+				name, _ := op.Value.(string)
+				if name == "" {
+					scimAbort(c, scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "invalid displayName"})
+					return
+				}
+				g.DisplayName = name
+			case op.Path == "members" && strings.EqualFold(op.Op, "remove") && op.Value == nil:
+				current = map[string]adminUser{}
+			case op.Path == "members":
+				values, err := memberValues(op.Value)
+				if err != nil {
+					scimAbort(c, err)
+					return
+				}
+				users, err := members(db, values)
+				if err != nil {
+					scimAbort(c, err)
+					return
+				}
+				if strings.EqualFold(op.Op, "replace") {
+					current = map[string]adminUser{}
+				}
+				for _, u := range users {
+					id := strconv.FormatUint(uint64(u.ID), 10)
+					if strings.EqualFold(op.Op, "remove") {
+						delete(current, id)
+					} else {
+						current[id] = u
+					}
+				}
+			case scimMemberPath.MatchString(op.Path) && strings.EqualFold(op.Op, "remove"):
+				delete(current, scimMemberPath.FindStringSubmatch(op.Path)[1])
+			default:
+				scimAbort(c, scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: fmt.Sprintf("unsupported %s of %s", op.Op, op.Path)})
+				return
+			}
+		}
+
+		users := []adminUser{}
+		for _, u := range current {
+			users = append(users, u)
+		}
+		if err := db.Model(&g).Update("display_name", g.DisplayName).Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if err := setMembers(db, &g, users); err != nil {
+			scimAbort(c, err)
+			return
+		}
+		scimJSON(c, http.StatusOK, s.toGroup(g))
+	}
+}
+
+// memberValues decodes the value of a members patch operation
+func memberValues(value interface{}) ([]scimValue, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "members must be a list"}
+	}
+	var values []scimValue
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "invalid member"}
+		}
+		values = append(values, scimValue{Value: fmt.Sprint(m["value"])})
+	}
+	return values, nil
+}
+
+// DeleteGroup is the SCIM handler for DELETE /Groups/:id
+func (s *scimConfig) DeleteGroup(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		g, err := findGroup(db, c)
+		if err != nil {
+			scimAbort(c, err)
+			return
+		}
+		previous := g.Members
+		if err := db.Model(&g).Association("Members").Clear().Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if err := db.Delete(&g).Error; err != nil {
+			scimAbort(c, err)
+			return
+		}
+		if err := refreshRoles(db, []string{g.Role}, previous...); err != nil {
+			scimAbort(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// bind registers the SCIM routes on the router group
+func (s *scimConfig) bind(g *gin.RouterGroup, db *gorm.DB) {
+	sg := g.Group("/scim/v2", s.Bearer)
+	{
+		sg.GET("/Users", s.ListUsers(db))
+		sg.POST("/Users", s.CreateUser(db))
+		sg.GET("/Users/:id", s.GetUser(db))
+		sg.PUT("/Users/:id", s.ReplaceUser(db))
+		sg.PATCH("/Users/:id", s.PatchUser(db))
+		sg.DELETE("/Users/:id", s.DeleteUser(db))
+		sg.GET("/Groups", s.ListGroups(db))
+		sg.POST("/Groups", s.CreateGroup(db))
+		sg.GET("/Groups/:id", s.GetGroup(db))
+		sg.PUT("/Groups/:id", s.ReplaceGroup(db))
+		sg.PATCH("/Groups/:id", s.PatchGroup(db))
+		sg.DELETE("/Groups/:id", s.DeleteGroup(db))
+	}
+}
@@ -0,0 +1,236 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+)
+
+const scimToken = "scim-secret"
+
+// testAuth returns the auth of an admin using the database, with a cookie
+// session store
+func testAuth(db *gorm.DB) *auth {
+	return &auth{
+		db:      db,
+		secret:  []byte("cookie-secret"),
+		metrics: newMetrics(MetricsConfig{}),
+		session: sessionConfig{key: "email", name: "admsession", store: cookie.NewStore([]byte("cookie-secret"))},
+	}
+}
+
+// login returns the session cookie of the user logged in at the time
+func login(t *testing.T, a *auth, u adminUser, at time.Time) *http.Cookie {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	s, err := a.session.store.Get(req, a.session.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Values[a.session.key] = u.Email
+	s.Values[sessionUserID] = u.ID
+	s.Values[sessionLoginAt] = at.UnixNano()
+	if err := s.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()[0]
+}
+
+// loggedIn reports if the session cookie still authenticates a user
+func loggedIn(a *auth, session *http.Cookie) bool {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(session)
+	return a.GetCurrentUser(&admin.Context{Context: &qor.Context{Request: req}}) != nil
+}
+
+// scimServer serves the SCIM endpoints on the database
+func scimServer(t *testing.T, db *gorm.DB) http.Handler {
+	t.Helper()
+	if err := db.AutoMigrate(&adminGroup{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	s := &scimConfig{token: []byte(scimToken), path: "/scim/v2"}
+	s.bind(e.Group(""), db)
+	return e
+}
+
+// scimDo sends the request with the bearer token and decodes the response
+// in out, if any
+func scimDo(t *testing.T, h http.Handler, method, path string, body, out interface{}) int {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Authorization", "Bearer "+scimToken)
+	req.Header.Set("Content-Type", "application/scim+json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil && rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, rec.Body)
+		}
+	}
+	return rec.Code
+}
+
+func TestSCIMBearer(t *testing.T) {
+	h := scimServer(t, testDB(t))
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "Bearer other", http.StatusUnauthorized},
+		{"without scheme", scimToken, http.StatusUnauthorized},
+		{"other scheme", "Basic " + scimToken, http.StatusUnauthorized},
+		{"valid", "Bearer " + scimToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/scim/v2/Users", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestSCIMUsers(t *testing.T) {
+	db := testDB(t)
+	h := scimServer(t, db)
+	a := testAuth(db)
+
+	var ada, bob scimUser
+	if status := scimDo(t, h, http.MethodPost, "/scim/v2/Users", scimUser{UserName: "ada@example.com", ExternalID: "ada", Name: scimName{GivenName: "Ada"}}, &ada); status != http.StatusCreated {
+		t.Fatalf("create: got %d", status)
+	}
+	if status := scimDo(t, h, http.MethodPost, "/scim/v2/Users", scimUser{UserName: "bob@example.com"}, &bob); status != http.StatusCreated {
+		t.Fatalf("create: got %d", status)
+	}
+	if ada.ID == "" || ada.UserName != "ada@example.com" || ada.Active == nil || !*ada.Active {
+		t.Fatalf("created %+v", ada)
+	}
+
+	var e map[string]interface{}
+	if status := scimDo(t, h, http.MethodPost, "/scim/v2/Users", scimUser{UserName: "ada@example.com"}, &e); status != http.StatusConflict || e["scimType"] != "uniqueness" {
+		t.Errorf("create a taken userName: got %d %v", status, e)
+	}
+	rename := map[string]interface{}{"Operations": []map[string]interface{}{{"op": "replace", "path": "userName", "value": "ada@example.com"}}}
+	if status := scimDo(t, h, http.MethodPatch, "/scim/v2/Users/"+bob.ID, rename, &e); status != http.StatusConflict || e["scimType"] != "uniqueness" {
+		t.Errorf("patch onto a taken userName: got %d %v", status, e)
+	}
+	if status := scimDo(t, h, http.MethodPut, "/scim/v2/Users/"+bob.ID, scimUser{UserName: "ada@example.com", ExternalID: "bob"}, &e); status != http.StatusConflict || e["scimType"] != "uniqueness" {
+		t.Errorf("put onto a taken userName: got %d %v", status, e)
+	}
+
+	// deactivating revokes the sessions
+	var user adminUser
+	db.First(&user, "email = ?", "ada@example.com")
+	session := login(t, a, user, time.Now())
+	if !loggedIn(a, session) {
+		t.Fatal("the session of an active user is rejected")
+	}
+	deactivate := map[string]interface{}{"Operations": []map[string]interface{}{{"op": "replace", "value": map[string]interface{}{"active": false}}}}
+	var got scimUser
+	if status := scimDo(t, h, http.MethodPatch, "/scim/v2/Users/"+ada.ID, deactivate, &got); status != http.StatusOK || *got.Active {
+		t.Errorf("deactivate: got %d %+v", status, got)
+	}
+	if loggedIn(a, session) {
+		t.Error("the session of a deactivated user still works")
+	}
+
+	// deleting ends the sessions too
+	db.First(&user, "email = ?", "bob@example.com")
+	session = login(t, a, user, time.Now())
+	if status := scimDo(t, h, http.MethodDelete, "/scim/v2/Users/"+bob.ID, nil, nil); status != http.StatusNoContent {
+		t.Errorf("delete: got %d", status)
+	}
+	if status := scimDo(t, h, http.MethodGet, "/scim/v2/Users/"+bob.ID, nil, nil); status != http.StatusNotFound {
+		t.Errorf("get a deleted user: got %d", status)
+	}
+	if loggedIn(a, session) {
+		t.Error("the session of a deleted user still works")
+	}
+}
+
+func TestSCIMGroups(t *testing.T) {
+	db := testDB(t)
+	h := scimServer(t, db)
+	var ada, bob scimUser
+	scimDo(t, h, http.MethodPost, "/scim/v2/Users", scimUser{UserName: "ada@example.com"}, &ada)
+	scimDo(t, h, http.MethodPost, "/scim/v2/Users", scimUser{UserName: "bob@example.com"}, &bob)
+	// a role granted by the CLI
+	db.Model(&adminUser{}).Where("email = ?", "ada@example.com").Update("roles", "support")
+
+	roles := func(email string) string {
+		var u adminUser
+		db.First(&u, "email = ?", email)
+		return u.Roles
+	}
+
+	var g scimGroup
+	create := scimGroup{DisplayName: "editors", Members: []scimValue{{Value: ada.ID}, {Value: bob.ID}, {Value: ada.ID}}}
+	if status := scimDo(t, h, http.MethodPost, "/scim/v2/Groups", create, &g); status != http.StatusCreated || len(g.Members) != 2 {
+		t.Fatalf("create with a duplicate member: got %d %+v", status, g)
+	}
+	if got := roles("ada@example.com"); got != "support,editors" {
+		t.Errorf("ada has the roles %q", got)
+	}
+	if got := roles("bob@example.com"); got != "editors" {
+		t.Errorf("bob has the roles %q", got)
+	}
+
+	var e map[string]interface{}
+	if status := scimDo(t, h, http.MethodPost, "/scim/v2/Groups", scimGroup{DisplayName: "editors"}, &e); status != http.StatusConflict {
+		t.Errorf("create a taken displayName: got %d", status)
+	}
+	unknown := map[string]interface{}{"Operations": []map[string]interface{}{{"op": "add", "path": "members", "value": []map[string]interface{}{{"value": "999"}}}}}
+	if status := scimDo(t, h, http.MethodPatch, "/scim/v2/Groups/"+g.ID, unknown, &e); status != http.StatusBadRequest {
+		t.Errorf("add an unknown member: got %d", status)
+	}
+
+	remove := map[string]interface{}{"Operations": []map[string]interface{}{{"op": "remove", "path": `members[value eq "` + bob.ID + `"]`}}}
+	if status := scimDo(t, h, http.MethodPatch, "/scim/v2/Groups/"+g.ID, remove, &g); status != http.StatusOK || len(g.Members) != 1 {
+		t.Errorf("remove a member: got %d %+v", status, g)
+	}
+	if got := roles("bob@example.com"); got != "" {
+		t.Errorf("the removed member has the roles %q", got)
+	}
+	add := map[string]interface{}{"Operations": []map[string]interface{}{{"op": "add", "path": "members", "value": []map[string]interface{}{{"value": bob.ID}, {"value": bob.ID}}}}}
+	if status := scimDo(t, h, http.MethodPatch, "/scim/v2/Groups/"+g.ID, add, &g); status != http.StatusOK || len(g.Members) != 2 {
+		t.Errorf("add a member twice: got %d %+v", status, g)
+	}
+
+	if status := scimDo(t, h, http.MethodDelete, "/scim/v2/Groups/"+g.ID, nil, nil); status != http.StatusNoContent {
+		t.Errorf("delete: got %d", status)
+	}
+	if got := roles("ada@example.com"); got != "support" {
+		t.Errorf("after the group deletion ada has the roles %q", got)
+	}
+	if got := roles("bob@example.com"); strings.Contains(got, "editors") {
+		t.Errorf("after the group deletion bob has the roles %q", got)
+	}
+}
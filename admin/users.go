@@ -0,0 +1,79 @@
+package admin
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrUserExists is returned by CreateUser when the email or brid is taken
+var ErrUserExists = errors.New("admin user already exists")
+
+// CreateUser creates a local account. The password must follow the password
+// rules, the user can sign in with it once local accounts are enabled.
+func (a *Admin) CreateUser(email, brid, password string, roles ...string) error {
+	var count int
+	if err := a.db.Model(&adminUser{}).Where("email = ? OR brid = ?", email, brid).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrUserExists
+	}
+	if err := a.db.AutoMigrate(&adminPassword{}).Error; err != nil {
+		return err
+	}
+	user := adminUser{Email: email, Brid: brid, Roles: strings.Join(roles, ",")}
+	if err := checkPasswordStrength(password, user); err != nil {
+		return err
+	}
+	if err := a.db.Create(&user).Error; err != nil {
+		return err
+	}
+	if err := setPassword(a.db, &user, password); err != nil {
+		a.db.Delete(&user)
+		return err
+	}
+	for _, role := range roles {
+		registerRole(role)
+	}
+	return nil
+}
+
+// DisableUser disables the user and revokes their sessions
+func (a *Admin) DisableUser(email string) error {
+	var user adminUser
+	if err := a.db.Where(adminUser{Email: email}).First(&user).Error; err != nil {
+		return err
+	}
+	return setActive(a.db, &user, false)
+}
+
+// SetUserRoles replaces the roles of the user
+func (a *Admin) SetUserRoles(email string, roles ...string) error {
+	var user adminUser
+	if err := a.db.Where(adminUser{Email: email}).First(&user).Error; err != nil {
+		return err
+	}
+	for _, role := range roles {
+		registerRole(role)
+	}
+	return a.db.Model(&user).Update("roles", strings.Join(roles, ",")).Error
+}
+
+// registerStoredRoles declares to qor the roles granted to the existing users,
+// they may have been set by another process, ex. the CLI
+func registerStoredRoles(db *gorm.DB) error {
+	var stored []string
+	if err := db.Model(&adminUser{}).Where("roles <> ''").Pluck("DISTINCT roles", &stored).Error; err != nil {
+		return err
+	}
+	for _, roles := range stored {
+		for _, role := range strings.Split(roles, ",") {
+			if role != "" {
+				registerRole(role)
+			}
+		}
+	}
+	return nil
+}
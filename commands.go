@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"qor-admin-3/admin"
+	"qor-admin-3/admin/ldap"
+	"qor-admin-3/admin/tracing"
+	"qor-admin-3/models"
+)
+
+// enable sets up the optional authentication modes, the provisioning and
+// the directory sync of the configuration
+func enable(cfg admin.Config, a *admin.Admin) error {
+	if cfg.ProxyAuth.Enabled {
+		if err := a.UseProxyAuth(cfg.ProxyAuth.ProxyAuth()); err != nil {
+			return err
+		}
+	}
+	if cfg.ClientCert.Enabled {
+		if err := a.UseClientCertAuth(cfg.ClientCert.ClientCert(cfg.LDAP)); err != nil {
+			return err
+		}
+	}
+	if cfg.SCIM.Enabled {
+		if err := a.UseSCIM(cfg.SCIM.SCIM()); err != nil {
+			return err
+		}
+	}
+	if cfg.LDAPSync.Enabled {
+		if err := a.UseLDAPSync(cfg.LDAPSync.LDAPSync(cfg.LDAP)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serve runs the admin server until SIGTERM
+func serve(cfg admin.Config, a *admin.Admin) int {
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Tracing())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to set up tracing:", err)
+		return exitFailure
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logrus.WithError(err).Warn("Couldn't flush the traces")
+		}
+	}()
+
+	if cfg.DynamoDB.Provision {
+		if err := a.Migrate(context.Background()); err != nil {
+			logrus.WithError(err).Error("Unable to provision the tables")
+			return exitFailure
+		}
+	}
+
+	if cfg.LocalAccounts.Enabled {
+		local, err := cfg.LocalAccounts.LocalAccounts()
+		if err == nil {
+			err = a.UseLocalAccounts(local)
+		}
+		if err != nil {
+			logrus.WithError(err).Error("Unable to enable the local accounts")
+			return exitFailure
+		}
+	}
+
+	// the authentication modes and the provisioning must be set up before Bind
+	if err := enable(cfg, a); err != nil {
+		logrus.WithError(err).Error("Unable to configure the admin")
+		return exitFailure
+	}
+
+	r := gin.New()
+	a.Bind(r)
+	a.StartJobs()
+
+	srv := &http.Server{
+		Addr:         cfg.Listen,
+		Handler:      r,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+	}
+	if cfg.Server.TLS() {
+		if srv.TLSConfig, err = a.TLSConfig(cfg.Server.TLSCert, cfg.Server.TLSKey); err != nil {
+			logrus.WithError(err).Error("Unable to load the TLS certificate")
+			return exitFailure
+		}
+	}
+
+	// the metrics and the log level are served without authentication on
+	// their own listener
+	var monitoring *http.Server
+	if cfg.Metrics.Listen != "" {
+		monitoring = &http.Server{
+			Addr:         cfg.Metrics.Listen,
+			Handler:      a.MetricsHandler(),
+			ReadTimeout:  cfg.Server.ReadTimeout,
+			WriteTimeout: cfg.Server.WriteTimeout,
+			IdleTimeout:  cfg.Server.IdleTimeout,
+		}
+		go func() {
+			logrus.WithField("address", cfg.Metrics.Listen).Info("Serving the metrics")
+			if err := monitoring.ListenAndServe(); err != http.ErrServerClosed {
+				logrus.WithError(err).Error("Metrics server stopped")
+			}
+		}()
+	}
+
+	// Stop accepting connections on SIGTERM and let the in-flight requests
+	// finish before closing the admin and the database
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		logrus.Info("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logrus.WithError(err).Warn("In-flight requests didn't finish in time")
+		}
+		if monitoring != nil {
+			monitoring.Shutdown(ctx)
+		}
+		close(done)
+	}()
+
+	logrus.WithField("address", cfg.Listen).WithField("tls", cfg.Server.TLS()).Info("Listening")
+	if cfg.Server.TLS() {
+		// the certificate is already in the TLS configuration, HTTP/2 is
+		// negotiated through ALPN
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logrus.WithError(err).Error("Server stopped")
+		return exitFailure
+	}
+	<-done
+	return exitOK
+}
+
+// migrate creates or updates the tables of the admin and the models
+func migrate(a *admin.Admin) int {
+	if err := a.Migrate(context.Background()); err != nil {
+		fmt.Fprintln(os.Stderr, "Migration failed:", err)
+		return exitFailure
+	}
+	fmt.Println("Migrated")
+	return exitOK
+}
+
+// compileAssets embeds the templates in admin/bindatafs
+func compileAssets(a *admin.Admin) int {
+	if err := a.CompileAssets(); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to compile the assets:", err)
+		return exitFailure
+	}
+	fmt.Println("Assets compiled, build with -tags bindatafs to embed them")
+	return exitOK
+}
+
+// parse parses the flags of a subcommand and checks the required ones
+func parse(flags *flag.FlagSet, args []string, required ...string) bool {
+	if err := flags.Parse(args); err != nil {
+		return false
+	}
+	for _, name := range required {
+		if flags.Lookup(name).Value.String() == "" {
+			fmt.Fprintf(os.Stderr, "-%s is required\n", name)
+			flags.Usage()
+			return false
+		}
+	}
+	return true
+}
+
+// splitRoles splits a comma separated list of roles
+func splitRoles(roles string) []string {
+	var list []string
+	for _, role := range strings.Split(roles, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			list = append(list, role)
+		}
+	}
+	return list
+}
+
+func createUser(a *admin.Admin, args []string) int {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the user")
+	brid := flags.String("brid", "", "unique identifier of the user")
+	roles := flags.String("roles", "", "comma separated roles")
+	if !parse(flags, args, "email", "brid") {
+		return exitUsage
+	}
+
+	// the password isn't a flag so it doesn't end up in the shell history
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		fmt.Fprintln(os.Stderr, "Unable to read the password:", err)
+		return exitFailure
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	if err := a.CreateUser(*email, *brid, password, splitRoles(*roles)...); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to create the user:", err)
+		return exitFailure
+	}
+	fmt.Println("Created", *email)
+	return exitOK
+}
+
+func disableUser(a *admin.Admin, args []string) int {
+	flags := flag.NewFlagSet("user disable", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the user")
+	if !parse(flags, args, "email") {
+		return exitUsage
+	}
+	if err := a.DisableUser(*email); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to disable the user:", err)
+		return exitFailure
+	}
+	fmt.Println("Disabled", *email)
+	return exitOK
+}
+
+func setRole(a *admin.Admin, args []string) int {
+	flags := flag.NewFlagSet("user set-role", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the user")
+	roles := flags.String("roles", "", "comma separated roles, replacing the current ones")
+	if !parse(flags, args, "email") {
+		return exitUsage
+	}
+	if err := a.SetUserRoles(*email, splitRoles(*roles)...); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to set the roles:", err)
+		return exitFailure
+	}
+	fmt.Println("Roles of", *email, "set to", *roles)
+	return exitOK
+}
+
+// checkLDAP binds with the read-only user and optionally looks up a user
+func checkLDAP(cfg admin.Config, args []string) int {
+	flags := flag.NewFlagSet("ldap check", flag.ContinueOnError)
+	user := flags.String("user", "", "login of a user to look up")
+	if !parse(flags, args) {
+		return exitUsage
+	}
+
+	client, err := ldap.New(cfg.LDAP.LDAP())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to connect to the directory:", err)
+		return exitFailure
+	}
+	defer client.Close()
+	if err := client.Ping(); err != nil {
+		fmt.Fprintln(os.Stderr, "Read-only bind failed:", err)
+		return exitFailure
+	}
+	fmt.Println("Bound to", cfg.LDAP.Host, "as", cfg.LDAP.BindDN)
+
+	if *user == "" {
+		return exitOK
+	}
+	entry, err := client.Lookup(*user)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find %s: %v\n", *user, err)
+		return exitFailure
+	}
+	fmt.Printf("DN:       %s\nUID:      %s\nMail:     %s\nName:     %s %s\nGroups:   %s\nDisabled: %t\n",
+		entry.DN, entry.UID, entry.Mail, entry.GivenName, entry.Surname, strings.Join(entry.Groups, ", "), entry.Disabled)
+	return exitOK
+}
+
+// fixtures is the content of a seed file
+type fixtures struct {
+	Users []struct {
+		Email    string   `yaml:"email"`
+		Brid     string   `yaml:"brid"`
+		Password string   `yaml:"password"`
+		Roles    []string `yaml:"roles"`
+	} `yaml:"users"`
+	Customers []struct {
+		ID          string `yaml:"id"`
+		Name        string `yaml:"name"`
+		Description string `yaml:"description"`
+	} `yaml:"customers"`
+}
+
+// seed loads the fixtures, the users which already exist are skipped
+func seed(cfg admin.Config, a *admin.Admin, args []string) int {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	file := flags.String("file", "", "YAML fixtures file")
+	if !parse(flags, args, "file") {
+		return exitUsage
+	}
+	content, err := ioutil.ReadFile(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	var f fixtures
+	if err := yaml.UnmarshalStrict(content, &f); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *file, err)
+		return exitUsage
+	}
+
+	for _, u := range f.Users {
+		err := a.CreateUser(u.Email, u.Brid, u.Password, u.Roles...)
+		switch {
+		case errors.Is(err, admin.ErrUserExists):
+			fmt.Println("Skipped existing user", u.Email)
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Unable to create the user %s: %v\n", u.Email, err)
+			return exitFailure
+		default:
+			fmt.Println("Created user", u.Email)
+		}
+	}
+
+	customers := make([]models.Customer, 0, len(f.Customers))
+	for _, c := range f.Customers {
+		customers = append(customers, models.Customer{ID: c.ID, Name: c.Name, Description: c.Description})
+	}
+	if err := models.SaveCustomers(context.Background(), cfg.DynamoDB.Models(), customers); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to save the customers:", err)
+		return exitFailure
+	}
+	fmt.Println("Saved", len(customers), "customer(s)")
+	return exitOK
+}
@@ -1,21 +1,135 @@
 package main
 
 import (
-	"github.com/gin-gonic/gin"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/sirupsen/logrus"
 
 	"qor-admin-3/admin"
+	"qor-admin-3/admin/logging"
+	"qor-admin-3/models"
+)
+
+// Exit codes of the commands
+const (
+	exitOK      = 0
+	exitFailure = 1 // the command failed
+	exitUsage   = 2 // invalid arguments or configuration
 )
 
+const usage = `Usage: qor-admin-3 [-config file] <command> [arguments]
+
+Commands:
+  serve                        start the admin server (default)
+  migrate                      create or update the database and DynamoDB tables, apply the migrations
+  assets compile               embed the templates, then build with -tags bindatafs
+  user create -email -brid [-roles]
+                               create a local account, the password is read from stdin
+  user disable -email          disable a user and revoke their sessions
+  user set-role -email -roles  replace the roles of a user, comma separated
+  ldap check [-user login]     test the LDAP configuration and look up a user
+  seed -file fixtures.yaml     load users and customers from a fixtures file
+
+Global flags:
+`
+
+// writes lists the commands whose changes would be lost with an in-memory
+// database
+var writes = map[string]bool{
+	"migrate":       true,
+	"user create":   true,
+	"user disable":  true,
+	"user set-role": true,
+	"seed":          true,
+}
+
+// inMemory reports if the database is discarded when the command exits
+func inMemory(db admin.DatabaseConfig) bool {
+	return db.Dialect == "sqlite3" && (strings.Contains(db.DSN, ":memory:") || strings.Contains(db.DSN, "mode=memory"))
+}
+
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	flags := flag.NewFlagSet("qor-admin-3", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path of a YAML or TOML configuration file, QOR_* environment variables override it")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
 
-	// Set up the database
-	DB, _ := gorm.Open("sqlite3", ":memory:")
+	cfg, err := admin.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := logging.Configure(logrus.StandardLogger(), cfg.Log.Level, cfg.Log.Format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	args = flags.Args()
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	if len(args) > 0 && (command == "assets" || command == "user" || command == "ldap") {
+		command, args = command+" "+args[0], args[1:]
+	}
+
+	if writes[command] && inMemory(cfg.Database) {
+		fmt.Fprintf(os.Stderr, "[CONFIG] %s needs a persistent database, database.dsn is %q\n", command, cfg.Database.DSN)
+		return exitUsage
+	}
+
+	switch command {
+	case "serve":
+		return withAdmin(cfg, func(a *admin.Admin) int { return serve(cfg, a) })
+	case "migrate":
+		return withAdmin(cfg, migrate)
+	case "assets compile":
+		return withAdmin(cfg, compileAssets)
+	case "user create":
+		return withAdmin(cfg, func(a *admin.Admin) int { return createUser(a, args) })
+	case "user disable":
+		return withAdmin(cfg, func(a *admin.Admin) int { return disableUser(a, args) })
+	case "user set-role":
+		return withAdmin(cfg, func(a *admin.Admin) int { return setRole(a, args) })
+	case "ldap check":
+		return checkLDAP(cfg, args)
+	case "seed":
+		return withAdmin(cfg, func(a *admin.Admin) int { return seed(cfg, a, args) })
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+	flags.Usage()
+	return exitUsage
+}
 
-	r := gin.New()
-	a := admin.New(DB, "", "secret")
-	a.Bind(r)
-	r.Run("127.0.0.1:8080")
+// withAdmin opens the database and the admin with its models, runs the
+// command then closes them
+func withAdmin(cfg admin.Config, command func(a *admin.Admin) int) int {
+	DB, err := gorm.Open(cfg.Database.Dialect, cfg.Database.DSN)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to open the database:", err)
+		return exitFailure
+	}
+	defer DB.Close()
 
+	a := admin.NewWithConfig(DB, cfg)
+	defer a.Close()
+	if _, err := a.Register(&models.Customer{}, admin.DynamoDB, admin.ResourceOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to register the customers:", err)
+		return exitFailure
+	}
+	return command(a)
 }
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"context"
+
+	"qor-admin-3/admin/dynamo"
+)
+
+// SaveCustomers writes the customers to DynamoDB, the ones without an ID get
+// a new one. It's used to load fixtures.
+func SaveCustomers(ctx context.Context, dc DynamoDBConfig, list []Customer) error {
+	db, err := dynamo.New(dc)
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		if err := db.Put(ctx, customers, &list[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}